@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// reservedIDs can't be used for resources since they are admin routes
+var reservedIDs = []string{"resources", "compatibility", "outbox", "relay"}
+
+func registerAdminRoutes(admin *http.ServeMux, registry *Registry) {
+	admin.Handle("/resources", basicAuth(resourcesHandler(registry)))
+	admin.Handle("/resources/{rid}", basicAuth(resourceHandlerFor(registry)))
+	admin.Handle("/compatibility", basicAuth(http.HandlerFunc(compatibilityHandler)))
+	admin.Handle("/outbox", basicAuth(http.HandlerFunc(outboxHandler)))
+	admin.Handle("/outbox/{oid}/retry", basicAuth(http.HandlerFunc(outboxRetryHandler)))
+	admin.Handle("/relay/{name}/_credentials", basicAuth(http.HandlerFunc(relayCredentialsHandler)))
+	// the broker behind the relay uses the credentials for its name
+	admin.Handle("/relay/{name}/_connect", http.HandlerFunc(relayConnectHandler))
+	admin.Handle("/relay/{name}/_responses/{rid}", http.HandlerFunc(relayResponseHandler))
+	// forwarded requests are authenticated by the broker behind the relay
+	admin.Handle("/relay/{name}/{path...}", http.HandlerFunc(relayProxyHandler))
+}
+
+func resourcesHandler(registry *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			resources := registry.List()
+			for _, resource := range resources {
+				resource.Mutex.RLock()
+				defer resource.Mutex.RUnlock()
+			}
+			writeJSON(w, http.StatusOK, resources)
+		case http.MethodPost:
+			createResource(registry, w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func createResource(registry *Registry, w http.ResponseWriter, r *http.Request) {
+	var c ResourceConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Provision != "" {
+		// commands can only be set by whoever runs the broker
+		http.Error(w, "Provision can only be set in the config file", http.StatusBadRequest)
+		return
+	}
+	resource, err := newConfigResource(c, registry.updater)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !registry.Add(resource) {
+		http.Error(w, fmt.Sprintf("Resource '%s' already exists", c.ID), http.StatusConflict)
+		return
+	}
+	log.Infof("Added resource %s", resource.ID)
+	w.Header().Set("Location", fmt.Sprintf("/resources/%s", resource.ID))
+	writeJSON(w, http.StatusCreated, resource)
+}
+
+func resourceHandlerFor(registry *Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rid := r.PathValue("rid")
+		switch r.Method {
+		case http.MethodGet:
+			resource, ok := registry.Get(rid)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Resource '%s' not found", rid), http.StatusNotFound)
+				return
+			}
+			resource.Mutex.RLock()
+			defer resource.Mutex.RUnlock()
+			writeJSON(w, http.StatusOK, resource)
+		case http.MethodPatch:
+			resource, ok := registry.Get(rid)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Resource '%s' not found", rid), http.StatusNotFound)
+				return
+			}
+			resource.Mutex.Lock()
+			defer resource.Mutex.Unlock()
+			sc := r.Context().Value(configKey).(ServerConfig)
+			updateResourceData(resource, &sc, w, r)
+		case http.MethodDelete:
+			resource, ok := registry.Remove(rid)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Resource '%s' not found", rid), http.StatusNotFound)
+				return
+			}
+			sc := r.Context().Value(configKey).(ServerConfig)
+			deleteResource(resource, &sc)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// deleteResource tears down all of the pipes of a removed resource and tells
+// the other end of each pipe that it is gone
+func deleteResource(resource *Resource, sc *ServerConfig) {
+	resource.Mutex.Lock()
+	defer resource.Mutex.Unlock()
+	pipes := []*Pipe{}
+	for pid, p := range resource.Pipes {
+		if p.Other.URI != "" && p.PeerState == "" {
+			deleteOther(sc.Prefix, p.Other.URI, p.This.URI)
+		}
+		delete(resource.Pipes, pid)
+		publishPipe(eventDeleted, resource, p)
+		pipes = append(pipes, p)
+	}
+	// adapters are unbound once the pipes are gone, since the resource is
+	// unlocked while they run
+	for _, p := range pipes {
+		unbindPipe(resource, p)
+	}
+	log.Infof("Deleted resource %s", resource.ID)
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func needHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	blueprintHandler(resource, false, w, r)
+}
+
+func offerHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	blueprintHandler(resource, true, w, r)
+}
+
+func blueprintHandler(resource *Resource, provider bool, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		resource.Mutex.RLock()
+		defer resource.Mutex.RUnlock()
+		readBlueprint(*resource.blueprints(provider), w, r)
+	case http.MethodPut:
+		resource.Mutex.Lock()
+		defer resource.Mutex.Unlock()
+		putBlueprint(resource, provider, w, r)
+	case http.MethodDelete:
+		resource.Mutex.Lock()
+		defer resource.Mutex.Unlock()
+		retireBlueprint(resource, provider, w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func needAdapterHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	templateHandler(resource, false, false, w, r)
+}
+
+func offerAdapterHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	templateHandler(resource, true, false, w, r)
+}
+
+func needProtoHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	templateHandler(resource, false, true, w, r)
+}
+
+func offerProtoHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	templateHandler(resource, true, true, w, r)
+}
+
+func templateHandler(resource *Resource, provider, proto bool, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		resource.Mutex.RLock()
+		defer resource.Mutex.RUnlock()
+		if proto {
+			readProto(*resource.blueprints(provider), w, r)
+		} else {
+			readAdapter(*resource.blueprints(provider), w, r)
+		}
+	case http.MethodPatch:
+		resource.Mutex.Lock()
+		defer resource.Mutex.Unlock()
+		updateTemplateData(resource, provider, proto, w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// putBlueprint creates or replaces a blueprint. Pipes bound to a replaced
+// blueprint keep the templates they were created with.
+func putBlueprint(resource *Resource, provider bool, w http.ResponseWriter, r *http.Request) {
+	sid := r.PathValue("sid")
+	var c BlueprintConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c.Name == "" {
+		c.Name = sid
+	}
+	if c.Name != sid {
+		http.Error(w, fmt.Sprintf("Blueprint name '%s' does not match '%s'", c.Name, sid), http.StatusBadRequest)
+		return
+	}
+	s, err := newConfigBlueprint(provider, c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if provider {
+		resource.attachProvision(s)
+	}
+	blueprints := resource.blueprints(provider)
+	for i, old := range *blueprints {
+		if old.Name == sid {
+			s.adopt(old)
+			for _, p := range resource.Pipes {
+				if p.blueprint == old {
+					p.blueprint = s
+				}
+			}
+			(*blueprints)[i] = s
+			log.Infof("Replaced blueprint %s on %s", sid, resource.ID)
+			writeJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+	*blueprints = append(*blueprints, s)
+	log.Infof("Added blueprint %s to %s", sid, resource.ID)
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// retireBlueprint stops new bindings to a blueprint. It is removed once it has
+// no pipes left.
+func retireBlueprint(resource *Resource, provider bool, w http.ResponseWriter, r *http.Request) {
+	sid := r.PathValue("sid")
+	for _, s := range *resource.blueprints(provider) {
+		if s.Name == sid {
+			s.Retired = true
+			resource.pruneBlueprints()
+			if s.PipeCount() == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("Blueprint '%s' not found", sid), http.StatusNotFound)
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -20,9 +21,62 @@ const version = "0.1.0"
 
 var log = logrus.WithFields(logrus.Fields{"version": version})
 
+var pluginsDir string
+var definitionsDir string
+var stateDir string
+var outboxMaxAttempts int
+var outboxWorkers int
+var updateDebounce time.Duration
+var peerRate float64
+var peerDeleteMode string
+var reconcileInterval time.Duration
+var reconcileConcurrency int
+var pullInterval time.Duration
+var pullWait time.Duration
+var relayURL string
+
 func init() {
 	// TODO(vish): turn this into a global flag
 	logrus.SetLevel(logrus.DebugLevel)
+	cmd.PersistentFlags().StringVar(&pluginsDir, "plugins", "", "directory of external adapter plugins")
+	cmd.PersistentFlags().StringVar(&definitionsDir, "definitions", "", "directory of proto and adapter definitions")
+	cmd.PersistentFlags().StringVar(&stateDir, "state-dir", "", "directory to persist pending updates to other brokers")
+	cmd.PersistentFlags().IntVar(&outboxMaxAttempts, "outbox-max-attempts", 50, "attempts before an update to another broker is dead-lettered, 0 retries forever")
+	cmd.PersistentFlags().IntVar(&outboxWorkers, "outbox-workers", 8, "maximum updates to other brokers sent at a time, 0 is unlimited")
+	cmd.PersistentFlags().DurationVar(&updateDebounce, "update-debounce", 500*time.Millisecond, "how long to wait for further changes to a pipe before sending it to the other end")
+	cmd.PersistentFlags().Float64Var(&peerRate, "peer-rate", 10, "maximum updates per second sent to each peer broker, 0 is unlimited")
+	cmd.PersistentFlags().StringVar(&peerDeleteMode, "on-peer-delete", peerDisconnected, "when the other end of a pipe is deleted, remove its data (disconnected) or keep it (orphaned)")
+	cmd.PersistentFlags().DurationVar(&reconcileInterval, "reconcile-interval", time.Minute, "how often to check that the other end of each pipe has our data, 0 disables")
+	cmd.PersistentFlags().IntVar(&reconcileConcurrency, "reconcile-concurrency", 2, "maximum concurrent checks per peer broker")
+	cmd.PersistentFlags().DurationVar(&pullInterval, "pull-interval", time.Second, "minimum time between fetches for pipes that pull data from the other end")
+	cmd.PersistentFlags().DurationVar(&pullWait, "pull-wait", 30*time.Second, "how long the other end holds a fetch open until the data changes, 0 disables long polling")
+	cmd.PersistentFlags().StringVar(&relayURL, "relay", "", "receive requests through a relay broker at this /relay/{name} url")
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if peerDeleteMode != peerDisconnected && peerDeleteMode != peerOrphaned {
+			return fmt.Errorf("invalid --on-peer-delete '%s'", peerDeleteMode)
+		}
+		if p, ok := os.LookupEnv("CLOUDPIPE_DEFINITIONS"); ok && definitionsDir == "" {
+			definitionsDir = p
+		}
+		if p, ok := os.LookupEnv("CLOUDPIPE_RELAY"); ok && relayURL == "" {
+			relayURL = p
+		}
+		if p, ok := os.LookupEnv("CLOUDPIPE_STATE_DIR"); ok && stateDir == "" {
+			stateDir = p
+		}
+		if definitionsDir != "" {
+			if err := loadDefinitions(definitionsDir); err != nil {
+				return err
+			}
+		}
+		if p, ok := os.LookupEnv("CLOUDPIPE_PLUGINS"); ok && pluginsDir == "" {
+			pluginsDir = p
+		}
+		if pluginsDir == "" {
+			return nil
+		}
+		return loadPlugins(pluginsDir)
+	}
 }
 
 // Execute runs the base command
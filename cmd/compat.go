@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/invopop/jsonschema"
+)
+
+// remoteTemplate and remoteBlueprint are the json form of a template and
+// blueprint served by another broker
+type remoteTemplate struct {
+	ID    string             `json:"id"`
+	This  *jsonschema.Schema `json:"this,omitempty"`
+	Other *jsonschema.Schema `json:"other,omitempty"`
+}
+
+type remoteBlueprint struct {
+	Name            string            `json:"name"`
+	Adapters        []*remoteTemplate `json:"adapters"`
+	DefaultAdapters []AdapterType     `json:"defaultAdapters"`
+	Protos          []*remoteTemplate `json:"protos"`
+	MaxPipes        int               `json:"maxPipes"`
+	Retired         bool              `json:"retired,omitempty"`
+}
+
+func findRemoteTemplate(templates []*remoteTemplate, id string) *remoteTemplate {
+	for _, t := range templates {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+var (
+	needURLPattern  = regexp.MustCompile(`/[^/]+/needs/[^/]+/?$`)
+	offerURLPattern = regexp.MustCompile(`/[^/]+/offers/[^/]+/?$`)
+)
+
+// brokerRequest creates a request to another broker. Credentials in the url
+// are sent as basic auth.
+func brokerRequest(method, rawURL string, body []byte) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url '%s': %w", rawURL, err)
+	}
+	user := u.User
+	u.User = nil
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+	}
+	return req, nil
+}
+
+var brokerClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchBlueprint reads the blueprint at a /{id}/needs/{name} or
+// /{id}/offers/{name} url
+func fetchBlueprint(rawURL string) (*remoteBlueprint, error) {
+	req, err := brokerRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := brokerClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching blueprint: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching blueprint %s: %s", rawURL, resp.Status)
+	}
+	var b remoteBlueprint
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		return nil, fmt.Errorf("invalid blueprint from %s: %w", rawURL, err)
+	}
+	return &b, nil
+}
+
+type SchemaCheck struct {
+	Satisfiable bool     `json:"satisfiable"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+type Combination struct {
+	Proto    ProtoType     `json:"proto"`
+	Adapters []AdapterType `json:"adapters"`
+	// whether the data the need expects from the offer can be provided by it
+	Schema SchemaCheck `json:"schema"`
+}
+
+type Compatibility struct {
+	Compatible   bool          `json:"compatible"`
+	Protos       []ProtoType   `json:"protos"`
+	Adapters     []AdapterType `json:"adapters"`
+	Combinations []Combination `json:"combinations"`
+	Problems     []string      `json:"problems,omitempty"`
+}
+
+// checkCompatibility compares a need and an offer. Combinations are listed in
+// the order of preference of the need.
+func checkCompatibility(need, offer *remoteBlueprint) *Compatibility {
+	c := &Compatibility{
+		Protos:       []ProtoType{},
+		Adapters:     []AdapterType{},
+		Combinations: []Combination{},
+		Problems:     []string{},
+	}
+	if need.Retired {
+		c.Problems = append(c.Problems, fmt.Sprintf("need '%s' is retired", need.Name))
+	}
+	if offer.Retired {
+		c.Problems = append(c.Problems, fmt.Sprintf("offer '%s' is retired", offer.Name))
+	}
+	for _, t := range need.Protos {
+		if findRemoteTemplate(offer.Protos, t.ID) != nil {
+			c.Protos = append(c.Protos, ProtoType(t.ID))
+		} else {
+			c.Problems = append(c.Problems, fmt.Sprintf("proto '%s' is not offered", t.ID))
+		}
+	}
+	for _, t := range offer.Protos {
+		if findRemoteTemplate(need.Protos, t.ID) == nil {
+			c.Problems = append(c.Problems, fmt.Sprintf("proto '%s' is not needed", t.ID))
+		}
+	}
+	for _, t := range need.Adapters {
+		if findRemoteTemplate(offer.Adapters, t.ID) != nil {
+			c.Adapters = append(c.Adapters, AdapterType(t.ID))
+		} else {
+			c.Problems = append(c.Problems, fmt.Sprintf("adapter '%s' is not supported by the offer", t.ID))
+		}
+	}
+	for _, t := range offer.Adapters {
+		if findRemoteTemplate(need.Adapters, t.ID) == nil {
+			c.Problems = append(c.Problems, fmt.Sprintf("adapter '%s' is not supported by the need", t.ID))
+		}
+	}
+
+	// candidate adapter sets, starting with the defaults of each end
+	sets := [][]AdapterType{}
+	addSet := func(set []AdapterType, source string) {
+		if len(set) == 0 {
+			return
+		}
+		for _, a := range set {
+			if !slices.Contains(c.Adapters, a) {
+				c.Problems = append(c.Problems, fmt.Sprintf("default adapters %v of the %s are not supported by both ends", set, source))
+				return
+			}
+		}
+		for _, s := range sets {
+			if slices.Equal(s, set) {
+				return
+			}
+		}
+		sets = append(sets, set)
+	}
+	addSet(need.DefaultAdapters, "need")
+	addSet(offer.DefaultAdapters, "offer")
+	for _, a := range c.Adapters {
+		addSet([]AdapterType{a}, "need")
+	}
+
+	for _, proto := range c.Protos {
+		for _, set := range sets {
+			combination := Combination{
+				Proto:    proto,
+				Adapters: set,
+				Schema:   checkSchemas(need, offer, proto, set),
+			}
+			c.Combinations = append(c.Combinations, combination)
+			if combination.Schema.Satisfiable {
+				c.Compatible = true
+			}
+		}
+	}
+	if need.Retired || offer.Retired {
+		c.Compatible = false
+	}
+	if len(c.Combinations) == 0 {
+		c.Problems = append(c.Problems, "no proto and adapters are supported by both ends")
+	}
+	return c
+}
+
+// Best returns the first satisfiable combination
+func (c *Compatibility) Best() *Combination {
+	if !c.Compatible {
+		return nil
+	}
+	for i := range c.Combinations {
+		if c.Combinations[i].Schema.Satisfiable {
+			return &c.Combinations[i]
+		}
+	}
+	return nil
+}
+
+// checkSchemas checks that the other schema of the need can be satisfied by
+// the this schema of the offer for a single combination
+func checkSchemas(need, offer *remoteBlueprint, proto ProtoType, adapters []AdapterType) SchemaCheck {
+	ids := []string{string(proto)}
+	for _, a := range adapters {
+		ids = append(ids, string(a))
+	}
+	expected := map[string]*jsonschema.Schema{}
+	required := []string{}
+	provided := map[string]*jsonschema.Schema{}
+	for _, id := range ids {
+		if t := findRemoteTemplate(slices.Concat(need.Protos, need.Adapters), id); t != nil {
+			required = append(required, flattenSchema(t.Other, expected)...)
+		}
+		if t := findRemoteTemplate(slices.Concat(offer.Protos, offer.Adapters), id); t != nil {
+			flattenSchema(t.This, provided)
+		}
+	}
+	check := SchemaCheck{Satisfiable: true}
+	fail := func(format string, args ...any) {
+		check.Satisfiable = false
+		check.Problems = append(check.Problems, fmt.Sprintf(format, args...))
+	}
+	for _, key := range required {
+		if _, ok := provided[key]; !ok {
+			fail("'%s' is required by the need but not provided by the offer", key)
+		}
+	}
+	keys := []string{}
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		want := expected[key]
+		got, ok := provided[key]
+		if !ok || want == nil || got == nil {
+			continue
+		}
+		if want.Type != "" && got.Type != "" && want.Type != got.Type {
+			fail("'%s' is a %s in the need but a %s in the offer", key, want.Type, got.Type)
+		}
+		if len(want.Enum) > 0 && len(got.Enum) > 0 {
+			overlap := false
+			for _, v := range got.Enum {
+				if slices.Contains(want.Enum, v) {
+					overlap = true
+					break
+				}
+			}
+			if !overlap {
+				fail("'%s' has no values allowed by both the need %v and the offer %v", key, want.Enum, got.Enum)
+			}
+		}
+		if want.Pattern != "" && got.Pattern != "" && want.Pattern != got.Pattern {
+			// patterns can't be compared, so only report the difference
+			check.Problems = append(check.Problems, fmt.Sprintf("'%s' must match '%s' in the need and '%s' in the offer", key, want.Pattern, got.Pattern))
+		}
+	}
+	return check
+}
+
+// flattenSchema collects the properties of a schema and any schemas it
+// combines with allOf, returning the required properties
+func flattenSchema(s *jsonschema.Schema, properties map[string]*jsonschema.Schema) []string {
+	if s == nil {
+		return nil
+	}
+	required := append([]string{}, s.Required...)
+	if s.Properties != nil {
+		for pair := s.Properties.Oldest(); pair != nil; pair = pair.Next() {
+			properties[pair.Key] = pair.Value
+		}
+	}
+	for _, item := range s.AllOf {
+		required = append(required, flattenSchema(item, properties)...)
+	}
+	return required
+}
+
+type compatibilityRequest struct {
+	Need  string `json:"need"`
+	Offer string `json:"offer"`
+}
+
+func compatibilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var input compatibilityRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if input.Need == "" || input.Offer == "" {
+		http.Error(w, "need and offer are required", http.StatusBadRequest)
+		return
+	}
+	if !needURLPattern.MatchString(input.Need) {
+		http.Error(w, fmt.Sprintf("need '%s' is not a /{id}/needs/{name} url", input.Need), http.StatusBadRequest)
+		return
+	}
+	if !offerURLPattern.MatchString(input.Offer) {
+		http.Error(w, fmt.Sprintf("offer '%s' is not a /{id}/offers/{name} url", input.Offer), http.StatusBadRequest)
+		return
+	}
+	need, err := fetchBlueprint(input.Need)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	offer, err := fetchBlueprint(input.Offer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, checkCompatibility(need, offer))
+}
@@ -0,0 +1,272 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	heroku "github.com/heroku/heroku-go/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// BrokerConfig declares the resources served by a broker
+type BrokerConfig struct {
+	Port      string           `json:"port,omitempty" yaml:"port"`
+	Auth      BrokerAuth       `json:"auth,omitempty" yaml:"auth"`
+	Sink      SinkConfig       `json:"sink,omitempty" yaml:"sink"`
+	Resources []ResourceConfig `json:"resources" yaml:"resources"`
+}
+
+// BrokerAuth is the basic auth required for the management api
+type BrokerAuth struct {
+	User string `json:"user,omitempty" yaml:"user"`
+	Pass string `json:"pass,omitempty" yaml:"pass"`
+}
+
+// SinkConfig selects where pipe data is written as config for the resource.
+// Type is one of "none", "env" or "heroku".
+type SinkConfig struct {
+	Type string `json:"type,omitempty" yaml:"type"`
+	// directory containing the .env file for the env sink
+	Path string `json:"path,omitempty" yaml:"path"`
+}
+
+type ResourceConfig struct {
+	ID     string            `json:"id" yaml:"id"`
+	Data   map[string]any    `json:"data,omitempty" yaml:"data"`
+	Needs  []BlueprintConfig `json:"needs,omitempty" yaml:"needs"`
+	Offers []BlueprintConfig `json:"offers,omitempty" yaml:"offers"`
+	// command that creates the credentials generated by auth:server on the
+	// resource, see provisionCredentials
+	Provision string `json:"provision,omitempty" yaml:"provision"`
+}
+
+type BlueprintConfig struct {
+	Name            string           `json:"name" yaml:"name"`
+	DefaultAdapters []AdapterType    `json:"defaultAdapters,omitempty" yaml:"defaultAdapters"`
+	MaxPipes        *int             `json:"maxPipes,omitempty" yaml:"maxPipes"`
+	Adapters        []TemplateConfig `json:"adapters,omitempty" yaml:"adapters"`
+	Protos          []TemplateConfig `json:"protos,omitempty" yaml:"protos"`
+}
+
+type TemplateConfig struct {
+	ID   string         `json:"id" yaml:"id"`
+	Data map[string]any `json:"data,omitempty" yaml:"data"`
+}
+
+var defaultAuth = BrokerAuth{User: "foo", Pass: "bar"}
+
+func parseBrokerConfig(content []byte) (*BrokerConfig, error) {
+	var config BrokerConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid broker config: %w", err)
+	}
+	if config.Auth.User == "" || config.Auth.Pass == "" {
+		// never fall back to well known credentials for the management api
+		return nil, fmt.Errorf("invalid broker config: auth.user and auth.pass are required")
+	}
+	return &config, nil
+}
+
+func loadBrokerConfig(path string) (*BrokerConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading broker config: %w", err)
+	}
+	return parseBrokerConfig(content)
+}
+
+func envUpdater(path string) configUpdater {
+	return func(name string, vars map[string]*string) error {
+		if err := updateToolsManifest(path, vars); err != nil {
+			return err
+		}
+		return updateEnv(path, vars)
+	}
+}
+
+func herokuUpdater(service *heroku.Service) configUpdater {
+	return func(name string, vars map[string]*string) error {
+		_, err := service.ConfigVarUpdate(context.TODO(), name, vars)
+		return err
+	}
+}
+
+func (c *SinkConfig) updater() (configUpdater, error) {
+	switch c.Type {
+	case "", "none":
+		return nil, nil
+	case "env":
+		path := c.Path
+		if path == "" {
+			path = "."
+		}
+		return envUpdater(path), nil
+	case "heroku":
+		token, ok := os.LookupEnv("HEROKU_API_KEY")
+		if !ok {
+			return nil, fmt.Errorf("HEROKU_API_KEY not set")
+		}
+		return herokuUpdater(heroku.NewService(&http.Client{
+			Transport: &heroku.Transport{
+				BearerToken: token,
+			},
+		})), nil
+	}
+	return nil, fmt.Errorf("unknown sink type '%s'", c.Type)
+}
+
+func newConfigTemplate(provider bool, c TemplateConfig, proto bool) (*PipeTemplate, error) {
+	var id PipeDefiner
+	if proto {
+		if _, ok := ProtoPipeTypes[ProtoType(c.ID)]; !ok {
+			return nil, fmt.Errorf("unknown proto '%s'", c.ID)
+		}
+		id = ProtoType(c.ID)
+	} else {
+		if _, ok := AuthPipeTypes[AdapterType(c.ID)]; !ok {
+			return nil, fmt.Errorf("unknown adapter '%s'", c.ID)
+		}
+		id = AdapterType(c.ID)
+	}
+	var data any
+	if c.Data != nil {
+		data = c.Data
+	}
+	t := NewTemplate(provider, id, data)
+	if err := t.ValidateData(); err != nil {
+		return nil, fmt.Errorf("invalid data for '%s': %w", c.ID, err)
+	}
+	return t, nil
+}
+
+func newConfigBlueprint(provider bool, c BlueprintConfig) (*Blueprint, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("blueprint is missing a name")
+	}
+	adapters := []*PipeTemplate{}
+	for _, a := range c.Adapters {
+		t, err := newConfigTemplate(provider, a, false)
+		if err != nil {
+			return nil, fmt.Errorf("blueprint '%s': %w", c.Name, err)
+		}
+		adapters = append(adapters, t)
+	}
+	protos := []*PipeTemplate{}
+	for _, p := range c.Protos {
+		t, err := newConfigTemplate(provider, p, true)
+		if err != nil {
+			return nil, fmt.Errorf("blueprint '%s': %w", c.Name, err)
+		}
+		protos = append(protos, t)
+	}
+	if len(protos) == 0 {
+		return nil, fmt.Errorf("blueprint '%s' has no protos", c.Name)
+	}
+	for _, d := range c.DefaultAdapters {
+		found := false
+		for _, a := range adapters {
+			if a.ID == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("blueprint '%s': default adapter '%s' is not in adapters", c.Name, d)
+		}
+	}
+	var b *Blueprint
+	if provider {
+		b = NewOffer(c.Name, c.DefaultAdapters, adapters, protos)
+	} else {
+		b = NewNeed(c.Name, c.DefaultAdapters, adapters, protos)
+	}
+	if c.MaxPipes != nil {
+		b.MaxPipes = *c.MaxPipes
+	}
+	return b, nil
+}
+
+func newConfigResource(c ResourceConfig, updater configUpdater) (*Resource, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("resource is missing an id")
+	}
+	if slices.Contains(reservedIDs, c.ID) {
+		return nil, fmt.Errorf("resource id '%s' is reserved", c.ID)
+	}
+	r := &Resource{
+		ID:     c.ID,
+		Pipes:  map[string]*Pipe{},
+		Needs:  []*Blueprint{},
+		Offers: []*Blueprint{},
+	}
+	if c.Data != nil {
+		r.DefaultData = c.Data
+	}
+	if c.Provision != "" {
+		path, err := filepath.Abs(c.Provision)
+		if err != nil {
+			return nil, fmt.Errorf("resource '%s': %w", c.ID, err)
+		}
+		r.Provision = path
+	}
+	for _, n := range c.Needs {
+		b, err := newConfigBlueprint(false, n)
+		if err != nil {
+			return nil, fmt.Errorf("resource '%s': %w", c.ID, err)
+		}
+		r.Needs = append(r.Needs, b)
+	}
+	for _, o := range c.Offers {
+		b, err := newConfigBlueprint(true, o)
+		if err != nil {
+			return nil, fmt.Errorf("resource '%s': %w", c.ID, err)
+		}
+		r.attachProvision(b)
+		r.Offers = append(r.Offers, b)
+	}
+	if updater != nil {
+		callback := func(pipe *Pipe) error {
+			return updateConfig(r.ID, pipe, r.Pipes, &r.noToolsManifest, updater)
+		}
+		r.UpdateCallback = &callback
+	}
+	return r, nil
+}
+
+// NewRegistry builds the resources declared in the config
+func (c *BrokerConfig) NewRegistry() (*Registry, error) {
+	updater, err := c.Sink.updater()
+	if err != nil {
+		return nil, err
+	}
+	registry := NewRegistry(nil, updater)
+	for _, rc := range c.Resources {
+		r, err := newConfigResource(rc, updater)
+		if err != nil {
+			return nil, err
+		}
+		if !registry.Add(r) {
+			return nil, fmt.Errorf("duplicate resource '%s'", r.ID)
+		}
+	}
+	return registry, nil
+}
+
+func runBrokerConfig(config *BrokerConfig, defaultPort string) error {
+	registry, err := config.NewRegistry()
+	if err != nil {
+		return err
+	}
+	port := config.Port
+	if port == "" {
+		port = defaultPort
+	}
+	return runBrokerServer(port, config.Auth, registry)
+}
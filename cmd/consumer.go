@@ -24,62 +24,9 @@ func init() {
 }
 
 func runConsumer() error {
-	resources := map[string]*Resource{}
-	resources["frontend"] = &Resource{
-		ID:     "frontend",
-		Pipes:  map[string]*Pipe{},
-		Offers: []*Blueprint{},
-		Needs: []*Blueprint{
-			NewNeed(
-				"db",
-				nil,
-				[]*PipeTemplate{
-					NewTemplate(
-						false,
-						OIDCAuth,
-						OIDCAuthData{
-							Issuer:   "https://oidc.heroku.com",
-							Subject:  "frontend",
-							Audience: "db",
-						},
-					),
-					NewTemplate(
-						false,
-						ServerAuth,
-						nil,
-					),
-				},
-				[]*PipeTemplate{
-					NewTemplate(
-						false,
-						ProtoPostgresqls,
-						nil,
-					),
-				},
-			),
-			NewNeed(
-				"backend",
-				[]AdapterType{OIDCAuth},
-				[]*PipeTemplate{
-					NewTemplate(
-						false,
-						OIDCAuth,
-						OIDCAuthData{
-							Issuer:   "https://oidc.heroku.com",
-							Subject:  "frontend",
-							Audience: "backend",
-						},
-					),
-				},
-				[]*PipeTemplate{
-					NewTemplate(
-						false,
-						ProtoHttps,
-						nil,
-					),
-				},
-			),
-		},
+	config, err := loadSampleConfig("consumer")
+	if err != nil {
+		return err
 	}
-	return runBrokerServer("8000", resources)
+	return runBrokerConfig(config, "8000")
 }
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+)
+
+// The data of a resource and of its templates is copied into pipes when they
+// are created. Updating it merges the change into this end of every pipe
+// created from it, which sends it on to the other end of each pipe.
+
+// DataUpdate is the body of a data update. The response has the merged data
+// and the pipes that changed.
+type DataUpdate struct {
+	Data  map[string]any `json:"data"`
+	Pipes []string       `json:"pipes"`
+}
+
+// updateResourceData merges data into the resource and the pipes created
+// with POST /{id}/pipes, which are the ones that get the resource data
+func updateResourceData(resource *Resource, sc *ServerConfig, w http.ResponseWriter, r *http.Request) {
+	input, ok := readDataUpdate(w, r)
+	if !ok {
+		return
+	}
+	merged, err := mergeData(resource.DefaultData, input.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pids, status, err := broadcastData(resource, input.Data, sc, func(p *Pipe) bool {
+		return p.blueprint == nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	resource.DefaultData = merged
+	log.Infof("Updated data of %s and %d pipes", resource.ID, len(pids))
+	writeJSON(w, http.StatusOK, DataUpdate{Data: merged, Pipes: pids})
+}
+
+// updateTemplateData merges data into a template of a blueprint and the
+// pipes that were created from it
+func updateTemplateData(resource *Resource, provider, proto bool, w http.ResponseWriter, r *http.Request) {
+	sid := r.PathValue("sid")
+	s := resource.findBlueprint(provider, sid)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("Blueprint '%s' not found", sid), http.StatusNotFound)
+		return
+	}
+	tid := r.PathValue("tid")
+	var t *PipeTemplate
+	if proto {
+		t = s.findTemplate(s.Protos, ProtoType(tid))
+	} else {
+		t = s.findTemplate(s.Adapters, AdapterType(tid))
+	}
+	if t == nil {
+		http.Error(w, fmt.Sprintf("Template '%s' not found", tid), http.StatusNotFound)
+		return
+	}
+	input, ok := readDataUpdate(w, r)
+	if !ok {
+		return
+	}
+	merged, err := mergeData(t.data, input.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	check := *t
+	check.data = merged
+	if err := check.ValidateData(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid data for '%s': %s", tid, err), http.StatusBadRequest)
+		return
+	}
+	sc := r.Context().Value(configKey).(ServerConfig)
+	pids, status, err := broadcastData(resource, input.Data, &sc, func(p *Pipe) bool {
+		return slices.Contains(p.templates, t)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	t.data = merged
+	log.Infof("Updated data of %s on %s/%s and %d pipes", tid, resource.ID, sid, len(pids))
+	writeJSON(w, http.StatusOK, DataUpdate{Data: merged, Pipes: pids})
+}
+
+func readDataUpdate(w http.ResponseWriter, r *http.Request) (*DataUpdate, bool) {
+	var input DataUpdate
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if len(input.Data) == 0 {
+		http.Error(w, "Missing data", http.StatusBadRequest)
+		return nil, false
+	}
+	return &input, true
+}
+
+// broadcastData merges data into this end of each pipe that matches. Every
+// pipe is checked before any is changed so an invalid update changes
+// nothing. It returns the ids of the pipes that changed, or the status to
+// respond with on failure.
+func broadcastData(resource *Resource, data map[string]any, sc *ServerConfig, match func(p *Pipe) bool) ([]string, int, error) {
+	pids := []string{}
+	for pid, p := range resource.Pipes {
+		if match(p) {
+			if resource.pipeBusy(pid) {
+				return nil, http.StatusConflict, fmt.Errorf("Pipe '%s' is busy", pid)
+			}
+			pids = append(pids, pid)
+		}
+	}
+	sort.Strings(pids)
+	updated := []*Pipe{}
+	calls := map[string][]*adapterCall{}
+	for _, pid := range pids {
+		existing := resource.Pipes[pid]
+		// local copy of existing pipe, including its secrets
+		p := *existing
+		p.secrets = maps.Clone(existing.secrets)
+		if err := p.This.SetData(data); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if sameJSON(p.This.Data, existing.This.Data) {
+			continue
+		}
+		updated = append(updated, &p)
+		calls[pid] = adapterCalls(&p)
+	}
+	update := func() error {
+		for _, p := range updated {
+			if err := callAdapters(calls[p.ID], func(h AdapterHandler, t *PipeTemplate) error {
+				return h.Update(p, t)
+			}); err != nil {
+				return fmt.Errorf("Could not update adapter for pipe '%s': %w", p.ID, err)
+			}
+		}
+		return nil
+	}
+	var err error
+	if slices.ContainsFunc(updated, func(p *Pipe) bool { return len(calls[p.ID]) > 0 }) {
+		// adapters may run external commands, so they run with the resource
+		// unlocked and the pipes marked busy
+		err = resource.unlockedFor(pids, update)
+	} else {
+		err = update()
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	for _, p := range updated {
+		if err := p.Validate(); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Data is not valid for pipe '%s': %w", p.ID, err)
+		}
+	}
+	changed := []string{}
+	for _, p := range updated {
+		existing, ok := resource.Pipes[p.ID]
+		if !ok {
+			// deleted along with its resource while unlocked
+			continue
+		}
+		applyPipe(resource, p, existing.This, existing.Other, sc)
+		changed = append(changed, p.ID)
+	}
+	return changed, 0, nil
+}
+
+// mergeData returns the keys of data laid over the keys of current
+func mergeData(current any, data map[string]any) (map[string]any, error) {
+	e := End{}
+	if current != nil {
+		if err := e.SetData(current); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.SetData(data); err != nil {
+		return nil, err
+	}
+	merged := map[string]any{}
+	if err := json.Unmarshal(e.Data, &merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+const (
+	protoDefinition   = "proto"
+	adapterDefinition = "adapter"
+)
+
+// typeDefinition declares a proto or adapter without recompiling. Like
+// ProtoPipeTypes and AuthPipeTypes, "this" is the schema of the data provided
+// by the end that needs the resource and "other" is the schema of the data
+// provided by the end that offers it.
+type typeDefinition struct {
+	Kind  string             `json:"kind"`
+	ID    string             `json:"id"`
+	This  *jsonschema.Schema `json:"this,omitempty"`
+	Other *jsonschema.Schema `json:"other,omitempty"`
+}
+
+// schemaTypes converts a pair of schemas to the layout of the PipeTypes
+// maps, leaving missing schemas as untyped nils
+func schemaTypes(this, other *jsonschema.Schema) [2]any {
+	types := [2]any{nil, nil}
+	if this != nil {
+		types[0] = this
+	}
+	if other != nil {
+		types[1] = other
+	}
+	return types
+}
+
+// loadDefinitions registers every json file in dir as a proto or adapter
+func loadDefinitions(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("error reading definitions directory: %w", err)
+	}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var def typeDefinition
+		if err := json.Unmarshal(content, &def); err != nil {
+			return fmt.Errorf("invalid definition %s: %w", path, err)
+		}
+		if def.ID == "" {
+			return fmt.Errorf("definition %s is missing an id", path)
+		}
+		switch strings.ToLower(def.Kind) {
+		case protoDefinition:
+			id := ProtoType(def.ID)
+			if _, ok := ProtoPipeTypes[id]; ok {
+				return fmt.Errorf("definition %s redefines proto '%s'", path, id)
+			}
+			log.Infof("Adding proto %s from %s", id, path)
+			ProtoPipeTypes[id] = schemaTypes(def.This, def.Other)
+		case adapterDefinition:
+			id := AdapterType(def.ID)
+			if _, ok := AuthPipeTypes[id]; ok {
+				return fmt.Errorf("definition %s redefines adapter '%s'", path, id)
+			}
+			log.Infof("Adding adapter %s from %s", id, path)
+			AuthPipeTypes[id] = schemaTypes(def.This, def.Other)
+			customAdapters = append(customAdapters, id)
+		default:
+			return fmt.Errorf("definition %s has unknown kind '%s'", path, def.Kind)
+		}
+	}
+	return nil
+}
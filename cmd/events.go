@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pipe events are streamed to clients with server-sent events. Each event has
+// a revision that clients can resume from with Last-Event-ID, as long as it
+// is still in the buffer of recent events.
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+	eventStatus  = "sync-status"
+	// sent instead of the missed events when a client can't be resumed
+	eventReset = "reset"
+
+	eventBufferSize   = 1000
+	eventHeartbeat    = 15 * time.Second
+	maskedValue       = "********"
+	subscriberBacklog = 64
+)
+
+type PipeEvent struct {
+	Revision uint64        `json:"revision"`
+	Type     string        `json:"type"`
+	Resource string        `json:"resource"`
+	PipeID   string        `json:"pipeId"`
+	Time     time.Time     `json:"time"`
+	Pipe     *Pipe         `json:"pipe,omitempty"`
+	Status   *StatusReport `json:"status,omitempty"`
+	// the event as sent to clients, encoded when it is published
+	encoded []byte
+}
+
+type eventHub struct {
+	mutex       sync.Mutex
+	revision    uint64
+	buffer      []*PipeEvent
+	subscribers map[chan *PipeEvent]struct{}
+}
+
+var events = &eventHub{subscribers: map[chan *PipeEvent]struct{}{}}
+
+func (h *eventHub) publish(e *PipeEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.revision++
+	e.Revision = h.revision
+	e.Time = time.Now().UTC()
+	var err error
+	if e.encoded, err = json.Marshal(e); err != nil {
+		log.Errorf("Error marshalling event: %v", err)
+		return
+	}
+	h.buffer = append(h.buffer, e)
+	if len(h.buffer) > eventBufferSize {
+		h.buffer = h.buffer[len(h.buffer)-eventBufferSize:]
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// the client can't keep up, so drop it and let it resume
+			close(ch)
+			delete(h.subscribers, ch)
+		}
+	}
+}
+
+// subscribe returns a channel for new events along with any buffered events
+// after last. If events after last are no longer buffered, ok is false.
+func (h *eventHub) subscribe(last uint64, resuming bool) (ch chan *PipeEvent, backlog []*PipeEvent, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ok = true
+	if resuming {
+		switch {
+		case last > h.revision:
+			// from before a restart
+			ok = false
+		case last < h.revision && (len(h.buffer) == 0 || h.buffer[0].Revision > last+1):
+			ok = false
+		}
+		for _, e := range h.buffer {
+			if ok && e.Revision > last {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	ch = make(chan *PipeEvent, subscriberBacklog)
+	h.subscribers[ch] = struct{}{}
+	return ch, backlog, ok
+}
+
+func (h *eventHub) unsubscribe(ch chan *PipeEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// publishPipe sends an event with a copy of the pipe with its data masked
+func publishPipe(kind string, resource *Resource, p *Pipe) {
+	e := &PipeEvent{Type: kind, Resource: resource.ID, PipeID: p.ID}
+	if kind != eventDeleted {
+		masked := *p
+		masked.This.Data = maskData(p.This.Data)
+		masked.Other.Data = maskData(p.Other.Data)
+		e.Pipe = &masked
+	}
+	events.publish(e)
+}
+
+// publishStatus sends an event if the state of the pipe changed since the
+// last status event
+func publishStatus(resource *Resource, pid string) {
+	resource.Mutex.RLock()
+	defer resource.Mutex.RUnlock()
+	p, ok := resource.Pipes[pid]
+	if !ok || p.Status == nil {
+		return
+	}
+	report := p.Status.report(p)
+	if !p.Status.statePublished(report.State) {
+		return
+	}
+	events.publish(&PipeEvent{Type: eventStatus, Resource: resource.ID, PipeID: pid, Status: report})
+}
+
+// maskData replaces the values in data so events don't leak secrets
+func maskData(data json.RawMessage) json.RawMessage {
+	if isJSONEmpty(data) {
+		return data
+	}
+	values := map[string]any{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil
+	}
+	for k := range values {
+		values[k] = maskedValue
+	}
+	masked, err := json.Marshal(values)
+	if err != nil {
+		return nil
+	}
+	return masked
+}
+
+func pipesEventsHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	streamEvents(resource.ID, "", w, r)
+}
+
+func pipeEventsHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	pid := r.PathValue("pid")
+	resource.Mutex.RLock()
+	_, ok := resource.Pipes[pid]
+	resource.Mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Pipe '%s' not found", pid), http.StatusNotFound)
+		return
+	}
+	streamEvents(resource.ID, pid, w, r)
+}
+
+// streamEvents writes events for the resource, or a single pipe if pid is
+// set, until the client goes away
+func streamEvents(rid, pid string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusNotImplemented)
+		return
+	}
+	var last uint64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID != "" {
+		var err error
+		if last, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid Last-Event-ID '%s'", lastID), http.StatusBadRequest)
+			return
+		}
+	}
+	ch, backlog, resumed := events.subscribe(last, lastID != "")
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if !resumed {
+		// the client has to read the pipes again
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", eventReset)
+	}
+	send := func(e *PipeEvent) {
+		if e.Resource != rid || (pid != "" && e.PipeID != pid) {
+			return
+		}
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Revision, e.Type, e.encoded)
+	}
+	for _, e := range backlog {
+		send(e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			send(e)
+			flusher.Flush()
+		}
+	}
+}
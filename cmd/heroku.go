@@ -40,7 +40,7 @@ func getResourceHeroku(name string, url string, discover bool, updater configUpd
 	if discover {
 		// TODO: use local run:insade to call `factor issuer` and parse output
 	}
-	return getResource(name, url, iss, sub, updater)
+	return getResource(name, url, iss, sub, nil, updater)
 }
 
 func runHeroku() error {
@@ -66,10 +66,7 @@ func runHeroku() error {
 	}
 	resources := map[string]*Resource{}
 
-	updater := func(name string, vars map[string]*string) error {
-		_, err := client.ConfigVarUpdate(context.TODO(), name, vars)
-		return err
-	}
+	updater := herokuUpdater(client)
 
 	if teamName == "" {
 		apps, err := client.AppList(context.TODO(), nil)
@@ -93,5 +90,5 @@ func runHeroku() error {
 
 	// TODO: watch for changes to app urls and update the other end of the pipe
 
-	return runBrokerServer("8002", resources)
+	return runBrokerServer("8002", defaultAuth, NewRegistry(resources, updater))
 }
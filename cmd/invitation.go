@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Invitations let a consumer bind to an offer without credentials for the
+// management api of the provider. The provider mints a signed token for an
+// offer, and the consumer broker redeems it to create the pipes on both ends.
+
+const defaultInvitationTTL = 24 * time.Hour
+
+// pipeIDPattern is what an invitee may name its pipe, which becomes part of
+// the url of the pipe
+var pipeIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Invitation is handed from the provider to the consumer out of band
+type Invitation struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	Resource  string    `json:"resource"`
+	Offer     string    `json:"offer"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type invitationRequest struct {
+	TTL string `json:"ttl,omitempty"`
+}
+
+// invitationStore tracks redeemed invitations so each can only be used once
+type invitationStore struct {
+	mutex sync.Mutex
+	used  map[string]time.Time
+}
+
+var invitations = &invitationStore{used: map[string]time.Time{}}
+
+// claim marks an invitation as used, returning false if it already was
+func (s *invitationStore) claim(id string, expires time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for k, exp := range s.used {
+		if exp.Before(now) {
+			// expired invitations are rejected anyway
+			delete(s.used, k)
+		}
+	}
+	if _, ok := s.used[id]; ok {
+		return false
+	}
+	s.used[id] = expires
+	return true
+}
+
+// release allows an invitation to be used again after a failed redemption
+func (s *invitationStore) release(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.used, id)
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func invitationsHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sid := r.PathValue("sid")
+	resource.Mutex.RLock()
+	s := resource.findBlueprint(true, sid)
+	resource.Mutex.RUnlock()
+	if s == nil {
+		http.Error(w, fmt.Sprintf("Blueprint '%s' not found", sid), http.StatusNotFound)
+		return
+	}
+	if s.Retired {
+		http.Error(w, fmt.Sprintf("Blueprint '%s' is retired", sid), http.StatusGone)
+		return
+	}
+	var input invitationRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := defaultInvitationTTL
+	if input.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(input.TTL); err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid ttl '%s'", input.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+	id, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sc := r.Context().Value(configKey).(ServerConfig)
+	path := fmt.Sprintf("/%s/offers/%s", resource.ID, sid)
+	inv := Invitation{
+		URL:       fmt.Sprintf("%s%s/invitations/redeem", sc.Prefix, path),
+		Resource:  resource.ID,
+		Offer:     sid,
+		ExpiresAt: time.Now().Add(ttl).Truncate(time.Second),
+	}
+	claims := jwt.MapClaims{
+		"iss": sc.Prefix,
+		"aud": inv.URL,
+		"sub": path,
+		"jti": id,
+		"exp": inv.ExpiresAt.Unix(),
+		"iat": time.Now().Unix(),
+	}
+	inv.Token, err = jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to sign invitation: %s", err), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Created invitation %s for %s", id, path)
+	writeJSON(w, http.StatusCreated, inv)
+}
+
+// parseInvitation checks that the invitation was signed by this broker for
+// the offer at path
+func parseInvitation(raw string, sc *ServerConfig, path string) (string, time.Time, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (any, error) {
+		return publicKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(sc.Prefix),
+		jwt.WithAudience(fmt.Sprintf("%s%s/invitations/redeem", sc.Prefix, path)),
+		jwt.WithSubject(path),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if claims.ID == "" {
+		return "", time.Time{}, errors.New("invitation has no id")
+	}
+	return claims.ID, claims.ExpiresAt.Time, nil
+}
+
+// redeemHandler creates the provider end of the pipe for an invitation. It is
+// authenticated by the invitation instead of basic auth.
+func redeemHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		http.Error(w, "Authorization required", http.StatusUnauthorized)
+		return
+	}
+	sid := r.PathValue("sid")
+	sc := r.Context().Value(configKey).(ServerConfig)
+	path := fmt.Sprintf("/%s/offers/%s", resource.ID, sid)
+	id, expires, err := parseInvitation(strings.TrimPrefix(auth, "Bearer "), &sc, path)
+	if err != nil {
+		log.Errorf("Invalid invitation: %s", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var input Binding
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !pipeIDPattern.MatchString(input.ID) {
+		http.Error(w, fmt.Sprintf("Invalid pipe id '%s'", input.ID), http.StatusBadRequest)
+		return
+	}
+	if input.Other.URI == "" || input.Other.Issuer == "" {
+		http.Error(w, "other uri and issuer are required", http.StatusBadRequest)
+		return
+	}
+	// the invitee only chooses where the other end is and what it speaks, the
+	// rest of the pipe comes from the offer
+	b := Binding{
+		Adapters:    input.Adapters,
+		Proto:       input.Proto,
+		AdapterSets: input.AdapterSets,
+		Protos:      input.Protos,
+	}
+	b.ID = input.ID
+	b.Other.URI = input.Other.URI
+	b.Other.Issuer = input.Other.Issuer
+	if !invitations.claim(id, expires) {
+		http.Error(w, "Invitation has already been used", http.StatusGone)
+		return
+	}
+	resource.Mutex.Lock()
+	defer resource.Mutex.Unlock()
+	s := resource.findBlueprint(true, sid)
+	if s == nil || s.Retired {
+		invitations.release(id)
+		http.Error(w, fmt.Sprintf("Blueprint '%s' is no longer available", sid), http.StatusGone)
+		return
+	}
+	if !bindBlueprint(resource, s, &b, path, &sc, w) {
+		invitations.release(id)
+		return
+	}
+	log.Infof("Redeemed invitation %s for %s", id, path)
+	writeBinding(resource, &b, w)
+}
+
+// acceptHandler redeems an invitation from a provider for a need and creates
+// the consumer end of the pipe
+func acceptHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var inv Invitation
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if inv.URL == "" || inv.Token == "" || inv.Resource == "" {
+		http.Error(w, "url, token and resource are required", http.StatusBadRequest)
+		return
+	}
+	if !pipeIDPattern.MatchString(inv.Resource) {
+		http.Error(w, fmt.Sprintf("Invalid resource '%s'", inv.Resource), http.StatusBadRequest)
+		return
+	}
+	sid := r.PathValue("sid")
+	sc := r.Context().Value(configKey).(ServerConfig)
+	// the pipe is named after the resource on the other end
+	pid := inv.Resource
+	resource.Mutex.RLock()
+	s, status, err := acceptableNeed(resource, sid, pid)
+	if err != nil {
+		resource.Mutex.RUnlock()
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// ask the provider for anything this need supports, in order of preference
+	supported := s.Supported()
+	resource.Mutex.RUnlock()
+	request := Binding{Protos: supported.Protos}
+	if len(supported.DefaultAdapters) > 0 {
+		request.AdapterSets = append(request.AdapterSets, supported.DefaultAdapters)
+	}
+	for _, a := range supported.Adapters {
+		request.AdapterSets = append(request.AdapterSets, []AdapterType{a})
+	}
+	request.ID = resource.ID
+	request.Other.URI = fmt.Sprintf("%s/%s/pipes/%s", sc.Prefix, resource.ID, pid)
+	request.Other.Issuer = sc.Prefix
+	body, err := json.Marshal(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req, err := brokerRequest(http.MethodPost, inv.URL, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", inv.Token))
+	// the resource is not locked while waiting for the provider, which may be
+	// this broker
+	resp, err := brokerClient.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error redeeming invitation: %s", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(resp.Body)
+		http.Error(w, fmt.Sprintf("Error redeeming invitation: %s: %s", resp.Status, strings.TrimSpace(string(msg))), http.StatusBadGateway)
+		return
+	}
+	var accepted Binding
+	if err := json.NewDecoder(resp.Body).Decode(&accepted); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid response from provider: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	b := Binding{Proto: accepted.Proto, Adapters: accepted.Adapters}
+	b.ID = pid
+	b.Other.URI = accepted.This.URI
+	b.Other.Issuer = accepted.This.Issuer
+	resource.Mutex.Lock()
+	defer resource.Mutex.Unlock()
+	// the need or its pipes may have changed while the resource was unlocked
+	s, status, err = acceptableNeed(resource, sid, pid)
+	if err != nil {
+		deleteOther(sc.Prefix, b.Other.URI, request.Other.URI)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	path := fmt.Sprintf("/%s/needs/%s", resource.ID, sid)
+	if !bindBlueprint(resource, s, &b, path, &sc, w) {
+		// remove the end that was just created by the provider
+		deleteOther(sc.Prefix, b.Other.URI, request.Other.URI)
+		return
+	}
+	writeBinding(resource, &b, w)
+}
+
+// acceptableNeed returns the need that an invitation is accepted for, or the
+// status and error to respond with if it can't be. The resource must be
+// locked.
+func acceptableNeed(resource *Resource, sid string, pid string) (*Blueprint, int, error) {
+	s := resource.findBlueprint(false, sid)
+	if s == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("Blueprint '%s' not found", sid)
+	}
+	if s.Retired {
+		return nil, http.StatusGone, fmt.Errorf("Blueprint '%s' is retired", sid)
+	}
+	if _, ok := resource.Pipes[pid]; ok {
+		return nil, http.StatusConflict, fmt.Errorf("Pipe '%s' already exists", pid)
+	}
+	return s, 0, nil
+}
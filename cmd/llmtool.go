@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const toolsManifestVar = "TOOLS_MANIFEST"
+
+type llmToolAuth struct {
+	Type     string `json:"type"`
+	Audience string `json:"audience"`
+	Issuer   string `json:"issuer,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+}
+
+type llmTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+	URL         string         `json:"url"`
+	Auth        *llmToolAuth   `json:"auth,omitempty"`
+}
+
+type llmToolsManifest struct {
+	Tools []llmTool `json:"tools"`
+}
+
+// getLLMTool returns the tool attached to the other end of the pipe, paired
+// with the oidc identity of this end if there is one.
+func getLLMTool(pipe *Pipe) (*llmTool, error) {
+	if isJSONEmpty(pipe.Other.Data) {
+		return nil, nil
+	}
+	var data LLMToolData
+	if err := json.Unmarshal(pipe.Other.Data, &data); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if data.Name == "" {
+		return nil, nil
+	}
+	tool := &llmTool{
+		Name:        data.Name,
+		Description: data.Description,
+		Parameters:  data.Parameters,
+		URL:         data.URL,
+	}
+	if !isJSONEmpty(pipe.This.Data) {
+		var identity OIDCAuthData
+		if err := json.Unmarshal(pipe.This.Data, &identity); err != nil {
+			return nil, fmt.Errorf("error unmarshaling JSON: %w", err)
+		}
+		if identity.Audience != "" {
+			tool.Auth = &llmToolAuth{
+				Type:     "oidc",
+				Audience: identity.Audience,
+				Issuer:   identity.Issuer,
+				Subject:  identity.Subject,
+			}
+		}
+	}
+	return tool, nil
+}
+
+func toLLMTool(pipe *Pipe, config map[string]*string) error {
+	tool, err := getLLMTool(pipe)
+	if err != nil || tool == nil {
+		return err
+	}
+	toolJson, err := json.Marshal(tool)
+	if err != nil {
+		return fmt.Errorf("error marshaling JSON: %w", err)
+	}
+	toolStr := string(toolJson)
+	config[strings.ToUpper(fmt.Sprintf("PIPE_%s_TOOL", pipe.ID))] = &toolStr
+	if tool.Auth != nil {
+		// set a config var to create an identity token for calling the tool
+		config[strings.ToUpper(fmt.Sprintf("%s_AUDIENCE", pipe.ID))] = &tool.Auth.Audience
+	}
+	return nil
+}
+
+// toToolsManifest aggregates the tools from all of the pipes of a resource.
+// The manifest is unset if there are no tools, unless it is known to be unset
+// already.
+func toToolsManifest(pipes map[string]*Pipe, unset bool, config map[string]*string) error {
+	ids := []string{}
+	for id := range pipes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	manifest := llmToolsManifest{Tools: []llmTool{}}
+	for _, id := range ids {
+		tool, err := getLLMTool(pipes[id])
+		if err != nil {
+			return err
+		}
+		if tool != nil {
+			manifest.Tools = append(manifest.Tools, *tool)
+		}
+	}
+	if len(manifest.Tools) == 0 {
+		if !unset {
+			// unset the manifest in case the last tool was removed
+			config[toolsManifestVar] = nil
+		}
+		return nil
+	}
+	manifestJson, err := json.Marshal(&manifest)
+	if err != nil {
+		return fmt.Errorf("error marshaling JSON: %w", err)
+	}
+	manifestStr := string(manifestJson)
+	config[toolsManifestVar] = &manifestStr
+	return nil
+}
+
+// parseToolMetadata reads an optional tool definition from the factor
+// metadata. The tool is served at tool_path relative to the app url.
+func parseToolMetadata(output []byte, url string) (*LLMToolData, error) {
+	var tool LLMToolData
+	var params, path string
+	lines := strings.Split(string(output), "\n")
+	for _, line := range lines {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "tool_name":
+			tool.Name = value
+		case "tool_description":
+			tool.Description = value
+		case "tool_parameters":
+			params = value
+		case "tool_path":
+			path = value
+		}
+	}
+	if tool.Name == "" {
+		return nil, nil
+	}
+	tool.Parameters = map[string]any{"type": "object"}
+	if params != "" {
+		if err := json.Unmarshal([]byte(params), &tool.Parameters); err != nil {
+			return nil, fmt.Errorf("invalid tool_parameters: %w", err)
+		}
+	}
+	tool.URL = fmt.Sprintf("%s/%s", strings.TrimSuffix(url, "/"), strings.TrimPrefix(path, "/"))
+	return &tool, nil
+}
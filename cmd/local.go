@@ -64,6 +64,8 @@ func updateEnv(path string, vars map[string]*string) error {
 	for k, v := range vars {
 		if v != nil {
 			content[k] = *v
+		} else {
+			delete(content, k)
 		}
 	}
 
@@ -100,6 +102,41 @@ func updateEnv(path string, vars map[string]*string) error {
 	return nil
 }
 
+// updateToolsManifest writes the aggregated tools manifest next to the .env
+// file so that agent runtimes can load it directly, and removes it when no
+// tools are left.
+func updateToolsManifest(path string, vars map[string]*string) error {
+	manifest, ok := vars[toolsManifestVar]
+	if !ok {
+		return nil
+	}
+	manifestPath := filepath.Join(path, "tools.json")
+	if manifest == nil {
+		// no tools are left
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// Write to a temp file for atomic update
+	tempFile, err := os.CreateTemp(os.TempDir(), "tools")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+
+	if _, err := tempFile.WriteString(*manifest); err != nil {
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, manifestPath)
+}
+
 func getResourceLocal(path string, factor string) *Resource {
 	// Run factor meta command and capture output
 	args := strings.Fields(factor)
@@ -111,11 +148,13 @@ func getResourceLocal(path string, factor string) *Resource {
 		return nil
 	}
 	name, url, iss, sub := parseMetadata(output)
-
-	updater := func(name string, vars map[string]*string) error {
-		return updateEnv(path, vars)
+	tool, err := parseToolMetadata(output, url)
+	if err != nil {
+		fmt.Printf("Error parsing tool metadata: %v\n", err)
+		return nil
 	}
-	return getResource(name, url, iss, sub, updater)
+
+	return getResource(name, url, iss, sub, tool, envUpdater(path))
 }
 
 func runLocal() error {
@@ -127,5 +166,5 @@ func runLocal() error {
 		return fmt.Errorf("failed to get resource")
 	}
 	resources := map[string]*Resource{r.ID: r}
-	return runBrokerServer("8003", resources)
+	return runBrokerServer("8003", defaultAuth, NewRegistry(resources, envUpdater(path)))
 }
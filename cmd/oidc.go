@@ -125,27 +125,33 @@ type Validator struct {
 	Sub *regexp.Regexp
 }
 
-func Validate(ctx context.Context, rawToken string, val Validator) error {
+// Validate verifies a token and returns it if it matches the validator. An
+// empty issuer would match any token, so it matches none.
+func Validate(ctx context.Context, rawToken string, val Validator) (*oidc.IDToken, error) {
+	if val.Iss == nil || val.Iss.String() == "" {
+		return nil, fmt.Errorf("no issuer to validate against")
+	}
+
 	issuer, err := getIssuer(rawToken)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !val.Iss.MatchString(issuer) {
-		return fmt.Errorf("unmatched issuer: %v %v", issuer, val.Iss)
+		return nil, fmt.Errorf("unmatched issuer: %v %v", issuer, val.Iss)
 	}
 
 	// TODO: cache providers
 	provider, err := oidc.NewProvider(ctx, issuer)
 	if err != nil {
-		return fmt.Errorf("failed to create provider: %w", err)
+		return nil, fmt.Errorf("failed to create provider: %w", err)
 	}
 
 	var verifier = provider.Verifier(&oidc.Config{SkipClientIDCheck: true})
 
 	token, err := verifier.Verify(ctx, rawToken)
 	if err != nil {
-		return fmt.Errorf("invalid token: %w", err)
+		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
 	match := false
@@ -156,12 +162,12 @@ func Validate(ctx context.Context, rawToken string, val Validator) error {
 		}
 	}
 	if !match {
-		return fmt.Errorf("unmatched audience: %v %v", token.Audience, val)
+		return nil, fmt.Errorf("unmatched audience: %v %v", token.Audience, val)
 	}
 
 	results := val.Sub.FindStringSubmatch(token.Subject)
 	if results == nil {
-		return fmt.Errorf("unmatched subject: %v %v", token.Subject, val)
+		return nil, fmt.Errorf("unmatched subject: %v %v", token.Subject, val)
 	}
-	return nil
+	return token, nil
 }
@@ -0,0 +1,489 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// headers that let the other end ignore updates that are out of order
+	// or repeated
+	sequenceHeader    = "Cloudpipe-Sequence"
+	idempotencyHeader = "Idempotency-Key"
+	// tells the sender why an update was accepted without being applied
+	ignoredHeader = "Cloudpipe-Ignored"
+)
+
+const (
+	baseDelay = 1 * time.Second // initial delay
+	maxDelay  = 5 * time.Minute // maximum delay
+	// how often the outbox looks for entries that are due
+	outboxInterval = 100 * time.Millisecond
+	// an update that keeps changing is sent after at most this many debounce
+	// periods
+	maxDebouncePeriods = 10
+)
+
+// OutboxEntry is a pending request to the other end of a pipe. There is at
+// most one update per pipe, a newer update replaces an older one.
+type OutboxEntry struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	// the token for the request is generated with these when it is sent
+	Issuer    string          `json:"issuer"`
+	Subject   string          `json:"subject"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Sequence  uint64          `json:"sequence"` // increases with every update
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	NextAt    time.Time       `json:"nextAttempt"`
+	// version changes whenever the entry is replaced so that the result of
+	// an older send doesn't remove a newer update
+	version  int
+	inFlight bool
+	// status of the pipe that sent the update, if it still exists
+	status *PipeStatus
+}
+
+type outboxState struct {
+	Pending []*OutboxEntry `json:"pending"`
+	Dead    []*OutboxEntry `json:"dead"`
+}
+
+// Outbox delivers updates to other brokers, retrying until they succeed or
+// MaxAttempts is reached. Entries are persisted if a state directory is set.
+type Outbox struct {
+	mutex   sync.Mutex
+	pending map[string]*OutboxEntry
+	dead    []*OutboxEntry
+	path    string
+	// the last sequence used
+	sequence uint64
+	// 0 retries forever
+	MaxAttempts int
+	send        func(e *OutboxEntry) error
+
+	// how long an update waits for a newer update from the same pipe
+	Debounce time.Duration
+	// maximum number of updates being sent at a time, 0 is unlimited
+	Workers int
+	// maximum requests per second to each peer host, 0 is unlimited
+	PeerRate float64
+	sending  int
+	limiters map[string]*rateLimiter
+}
+
+var outbox = NewOutbox()
+
+func NewOutbox() *Outbox {
+	o := &Outbox{
+		pending:  map[string]*OutboxEntry{},
+		dead:     []*OutboxEntry{},
+		limiters: map[string]*rateLimiter{},
+	}
+	o.send = o.sendEntry
+	return o
+}
+
+// Start loads any persisted entries and begins delivering them
+func (o *Outbox) Start(stateDir string, maxAttempts, workers int, debounce time.Duration, peerRate float64) error {
+	o.mutex.Lock()
+	o.MaxAttempts = maxAttempts
+	o.Workers = workers
+	o.Debounce = debounce
+	o.PeerRate = peerRate
+	if stateDir != "" {
+		if err := os.MkdirAll(stateDir, 0700); err != nil {
+			o.mutex.Unlock()
+			return fmt.Errorf("error creating state directory: %w", err)
+		}
+		o.path = filepath.Join(stateDir, "outbox.json")
+		if err := o.load(); err != nil {
+			o.mutex.Unlock()
+			return err
+		}
+	}
+	o.mutex.Unlock()
+	go func() {
+		for {
+			o.deliver()
+			time.Sleep(outboxInterval)
+		}
+	}()
+	return nil
+}
+
+func (o *Outbox) load() error {
+	content, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading outbox: %w", err)
+	}
+	var state outboxState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("invalid outbox %s: %w", o.path, err)
+	}
+	for _, e := range state.Pending {
+		o.pending[e.key()] = e
+		o.sequence = max(o.sequence, e.Sequence)
+	}
+	if state.Dead != nil {
+		o.dead = state.Dead
+	}
+	log.Infof("Loaded %d pending and %d dead updates from %s", len(o.pending), len(o.dead), o.path)
+	return nil
+}
+
+// save writes the outbox to disk. It must be called with the mutex held.
+func (o *Outbox) save() {
+	if o.path == "" {
+		return
+	}
+	content, err := json.MarshalIndent(o.state(), "", "  ")
+	if err != nil {
+		log.Errorf("Error marshalling outbox: %v", err)
+		return
+	}
+	// Write to a temp file for atomic update
+	tempFile, err := os.CreateTemp(filepath.Dir(o.path), "outbox")
+	if err != nil {
+		log.Errorf("Error saving outbox: %v", err)
+		return
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+	defer tempFile.Close()
+	if _, err := tempFile.Write(content); err != nil {
+		log.Errorf("Error saving outbox: %v", err)
+		return
+	}
+	if err := tempFile.Close(); err != nil {
+		log.Errorf("Error saving outbox: %v", err)
+		return
+	}
+	if err := os.Rename(tempPath, o.path); err != nil {
+		log.Errorf("Error saving outbox: %v", err)
+	}
+}
+
+// state returns a snapshot of the entries. It must be called with the mutex
+// held.
+func (o *Outbox) state() outboxState {
+	state := outboxState{
+		Pending: []*OutboxEntry{},
+		Dead:    []*OutboxEntry{},
+	}
+	for _, e := range o.pending {
+		c := *e
+		state.Pending = append(state.Pending, &c)
+	}
+	sort.Slice(state.Pending, func(i, j int) bool {
+		return state.Pending[i].CreatedAt.Before(state.Pending[j].CreatedAt)
+	})
+	for _, e := range o.dead {
+		c := *e
+		state.Dead = append(state.Dead, &c)
+	}
+	return state
+}
+
+// key identifies the pipe that an entry is for. Updates are sent from the
+// pipe at subject, while deletes are sent to the pipe at uri since the pipe
+// at subject is gone.
+func (e *OutboxEntry) key() string {
+	if e.Method == http.MethodDelete {
+		return fmt.Sprintf("%s %s", e.Method, e.URI)
+	}
+	return fmt.Sprintf("%s %s", e.Method, e.Subject)
+}
+
+// Enqueue adds a request to uri, replacing any pending request from the same
+// pipe. Updates wait for the debounce period so that only the latest of a
+// burst of changes is sent.
+func (o *Outbox) Enqueue(method, uri, issuer, subject string, payload json.RawMessage, status *PipeStatus) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	now := time.Now()
+	if method == http.MethodDelete {
+		// a delete supersedes any update that hasn't been sent yet
+		update := &OutboxEntry{Method: http.MethodPatch, Subject: subject}
+		if e, ok := o.pending[update.key()]; ok && e.URI == uri {
+			delete(o.pending, update.key())
+		}
+	}
+	k := (&OutboxEntry{Method: method, URI: uri, Subject: subject}).key()
+	e, ok := o.pending[k]
+	if !ok {
+		id, err := randomID()
+		if err != nil {
+			log.Errorf("Error creating outbox entry: %v", err)
+			return
+		}
+		e = &OutboxEntry{
+			ID:        id,
+			Method:    method,
+			Subject:   subject,
+			CreatedAt: now,
+		}
+		o.pending[k] = e
+	} else {
+		log.Debugf("Replacing pending update from %s", subject)
+	}
+	e.URI = uri
+	e.Issuer = issuer
+	e.Payload = payload
+	e.Sequence = o.nextSequence()
+	e.status = status
+	e.UpdatedAt = now
+	e.NextAt = now
+	if method == http.MethodPatch && o.Debounce > 0 {
+		e.NextAt = now.Add(o.Debounce)
+		// don't wait forever for a pipe that keeps changing
+		if limit := e.CreatedAt.Add(maxDebouncePeriods * o.Debounce); limit.Before(e.NextAt) {
+			e.NextAt = limit
+		}
+	}
+	e.version++
+	o.save()
+}
+
+// Pending returns true if an update from the pipe at subject hasn't been
+// delivered yet
+func (o *Outbox) Pending(subject string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	_, ok := o.pending[(&OutboxEntry{Method: http.MethodPatch, Subject: subject}).key()]
+	return ok
+}
+
+// nextSequence returns a sequence higher than any used before. It is based
+// on the time so that it keeps increasing after a restart. It must be called
+// with the mutex held.
+func (o *Outbox) nextSequence() uint64 {
+	o.sequence = max(o.sequence+1, uint64(time.Now().UnixNano()))
+	return o.sequence
+}
+
+// idempotencyKey is the same for every attempt to send an update
+func (e *OutboxEntry) idempotencyKey() string {
+	return fmt.Sprintf("%s.%d", e.ID, e.Sequence)
+}
+
+// deliver sends the entries that are due, oldest first, as long as there is
+// a free worker and the rate limit for the peer allows it
+func (o *Outbox) deliver() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	now := time.Now()
+	due := []*OutboxEntry{}
+	for _, e := range o.pending {
+		if !e.inFlight && !e.NextAt.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAt.Before(due[j].NextAt)
+	})
+	for _, e := range due {
+		if o.Workers > 0 && o.sending >= o.Workers {
+			return
+		}
+		if !o.allow(e.URI, now) {
+			continue
+		}
+		e.inFlight = true
+		o.sending++
+		e.status.attempt()
+		c := *e
+		go func() {
+			o.finish(&c, o.send(&c))
+		}()
+	}
+}
+
+// rateLimiter is a token bucket for requests to one peer host
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token for the host of uri if one is available. It must be
+// called with the mutex held.
+func (o *Outbox) allow(uri string, now time.Time) bool {
+	if o.PeerRate <= 0 {
+		return true
+	}
+	host := uri
+	if u, err := url.Parse(uri); err == nil {
+		host = u.Host
+	}
+	burst := max(o.PeerRate, 1)
+	l, ok := o.limiters[host]
+	if !ok {
+		l = &rateLimiter{tokens: burst, last: now}
+		o.limiters[host] = l
+	}
+	l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*o.PeerRate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// finish records the result of sending an entry
+func (o *Outbox) finish(sent *OutboxEntry, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.sending--
+	e, ok := o.pending[sent.key()]
+	if !ok || e.ID != sent.ID {
+		return
+	}
+	e.inFlight = false
+	if err == nil {
+		sent.status.sent(nil, 0)
+	} else {
+		sent.status.sent(err, e.Attempts+1)
+	}
+	if e.version != sent.version {
+		// replaced while sending, so the newer update is sent when it is due
+		return
+	}
+	if err == nil {
+		delete(o.pending, e.key())
+		o.save()
+		return
+	}
+	e.Attempts++
+	e.LastError = err.Error()
+	if o.MaxAttempts > 0 && e.Attempts >= o.MaxAttempts {
+		log.Warnf("Failed to send update to %s after %d attempts: %v", e.URI, e.Attempts, err)
+		delete(o.pending, e.key())
+		o.dead = append(o.dead, e)
+		o.save()
+		return
+	}
+	delay := backoff(e.Attempts)
+	e.NextAt = time.Now().Add(delay)
+	log.Infof("Retrying in %v due to error: %v", delay, err)
+	o.save()
+}
+
+// backoff doubles the delay for each attempt with up to 25% jitter
+func backoff(attempts int) time.Duration {
+	delay := baseDelay * time.Duration(math.Pow(2, float64(min(attempts-1, 20))))
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/4 + 1))
+	return delay - jitter
+}
+
+func (o *Outbox) sendEntry(e *OutboxEntry) error {
+	token, err := generateToken(e.Issuer, e.URI, e.Subject)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set(sequenceHeader, strconv.FormatUint(e.Sequence, 10))
+	header.Set(idempotencyHeader, e.idempotencyKey())
+	return doRequest(e.Method, token, e.URI, e.Payload, header)
+}
+
+// Retry sends a pending or dead entry again right away
+func (o *Outbox) Retry(id string) (*OutboxEntry, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, e := range o.pending {
+		if e.ID == id {
+			e.NextAt = time.Now()
+			o.save()
+			c := *e
+			return &c, true
+		}
+	}
+	for i, e := range o.dead {
+		if e.ID != id {
+			continue
+		}
+		o.dead = append(o.dead[:i], o.dead[i+1:]...)
+		if _, ok := o.pending[e.key()]; ok {
+			// a newer update for the same pipe supersedes this one
+			o.save()
+			return e, true
+		}
+		e.Attempts = 0
+		e.NextAt = time.Now()
+		o.pending[e.key()] = e
+		o.save()
+		c := *e
+		return &c, true
+	}
+	return nil, false
+}
+
+// checkSequence returns false with the reason if an update from the other end
+// is a repeat of or older than the last update applied to p. Otherwise it
+// records the update in p.
+func checkSequence(p *Pipe, r *http.Request) (bool, string, error) {
+	raw := r.Header.Get(sequenceHeader)
+	if raw == "" {
+		return true, "", nil
+	}
+	sequence, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return false, "", fmt.Errorf("invalid %s '%s'", sequenceHeader, raw)
+	}
+	key := r.Header.Get(idempotencyHeader)
+	if key != "" && key == p.inboundKey {
+		return false, "duplicate", nil
+	}
+	if sequence <= p.inboundSequence {
+		return false, "stale", nil
+	}
+	p.inboundSequence = sequence
+	p.inboundKey = key
+	return true, "", nil
+}
+
+func outboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	outbox.mutex.Lock()
+	state := outbox.state()
+	outbox.mutex.Unlock()
+	writeJSON(w, http.StatusOK, state)
+}
+
+func outboxRetryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("oid")
+	e, ok := outbox.Retry(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Update '%s' not found", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, e)
+}
@@ -20,15 +20,46 @@ const (
 	SecretAuth AdapterType = "auth:secret"
 	ServerAuth AdapterType = "auth:server"
 	//IpsecEnc AdapterType = "enc:ipsec"
+	WireguardConn AdapterType = "conn:wireguard"
+	LLMToolMeta   AdapterType = "meta:llm-tool"
 	//PrivateLinkConn AdapterType = "conn:privateLink"
 )
 
 var AuthPipeTypes = map[AdapterType][2]any{
-	OIDCAuth:   {&OIDCAuthData{}, nil},
-	MtlsAuth:   {&MtlsAuthData{}, nil},
-	BasicAuth:  {&BasicAuthData{}, nil},
-	SecretAuth: {&SecretAuthData{}, nil},
-	ServerAuth: {nil, &BasicAuthData{}}, // should probably be reversed basic
+	OIDCAuth:      {&OIDCAuthData{}, nil},
+	MtlsAuth:      {&MtlsAuthData{}, nil},
+	BasicAuth:     {&BasicAuthData{}, nil},
+	SecretAuth:    {&SecretAuthData{}, nil},
+	ServerAuth:    {nil, &ServerAuthData{}},
+	WireguardConn: {&WireguardConnData{}, &WireguardConnData{}},
+	LLMToolMeta:   {nil, &LLMToolData{}},
+}
+
+// AdapterHandler is implemented by adapters whose data is generated by the
+// broker for each pipe instead of being copied from the template. Handlers
+// may run external commands, so they are called with the resource unlocked
+// and the pipe marked busy.
+type AdapterHandler interface {
+	// Bind is called once the template data has been merged into a new pipe.
+	Bind(p *Pipe, t *PipeTemplate) error
+	// Update is called when a PATCH changes either end of the pipe.
+	Update(p *Pipe, t *PipeTemplate) error
+	// Rotate replaces any generated credentials on an existing pipe.
+	Rotate(p *Pipe, t *PipeTemplate) error
+	// Unbind is called when the pipe is deleted.
+	Unbind(p *Pipe, t *PipeTemplate) error
+}
+
+var AdapterHandlers = map[AdapterType]AdapterHandler{
+	ServerAuth:    serverAuthHandler{},
+	WireguardConn: wireguardHandler{},
+}
+
+func getAdapterHandler(t *PipeTemplate) AdapterHandler {
+	if a, ok := t.ID.(AdapterType); ok {
+		return AdapterHandlers[a]
+	}
+	return nil
 }
 
 type OIDCAuthData struct {
@@ -42,6 +73,12 @@ type BasicAuthData struct {
 	Pass string `json:"PASS"`
 }
 
+// ServerAuthData holds credentials generated by the server for the client
+type ServerAuthData struct {
+	Username string `json:"USERNAME"`
+	Password string `json:"PASSWORD"`
+}
+
 type MtlsAuthData struct {
 	ClientCert string `json:"CLIENT_CERT"`
 	ClientKey  string `json:"CLIENT_KEY"`
@@ -52,35 +89,104 @@ type SecretAuthData struct {
 	Secret string `json:"SECRET"`
 }
 
+type WireguardConnData struct {
+	PublicKey  string `json:"WG_PUBLIC_KEY"`
+	Endpoint   string `json:"WG_ENDPOINT,omitempty"`
+	AllowedIPs string `json:"WG_ALLOWED_IPS"`
+}
+
+// LLMToolData describes an http tool that can be called by an agent.
+// Parameters is the JSON schema of the request body.
+type LLMToolData struct {
+	Name        string         `json:"TOOL_NAME"`
+	Description string         `json:"TOOL_DESCRIPTION"`
+	Parameters  map[string]any `json:"TOOL_PARAMETERS"`
+	URL         string         `json:"TOOL_URL" jsonschema:"pattern=^https?://"`
+}
+
 type URIData struct {
 	URI string `json:"URI"`
 }
 
 type URIHttpsData struct {
-	// TODO: improve regex
 	URI string `json:"URI" jsonschema:"pattern=^https://"`
 }
 
+// URIPostgresqlsData accepts any postgres scheme, tls is required either by
+// the postgresqls scheme or by the sslmode parameter
 type URIPostgresqlsData struct {
-	// TODO: improve regex
-	URI string `json:"URI" jsonschema:"pattern=^postgresqls://"`
+	URI string `json:"URI" jsonschema:"pattern=^(postgres|postgresql|postgresqls)://"`
 }
 
 type URIRedissData struct {
-	// TODO: improve regex
 	URI string `json:"URI" jsonschema:"pattern=^rediss://"`
 }
 
+type URIMysqlData struct {
+	URI string `json:"URI" jsonschema:"pattern=^mysql://"`
+}
+
+type URIMongodbData struct {
+	URI string `json:"URI" jsonschema:"pattern=^mongodb(\\+srv)?://"`
+}
+
+type URIAmqpsData struct {
+	URI string `json:"URI" jsonschema:"pattern=^amqps://"`
+}
+
+// KafkaData lists the brokers as comma separated host:port pairs
+type KafkaData struct {
+	BootstrapServers string `json:"BOOTSTRAP_SERVERS"`
+	SecurityProtocol string `json:"SECURITY_PROTOCOL" jsonschema:"enum=SSL,enum=SASL_SSL"`
+	SASLMechanism    string `json:"SASL_MECHANISM,omitempty" jsonschema:"enum=PLAIN,enum=SCRAM-SHA-256,enum=SCRAM-SHA-512,enum=OAUTHBEARER"`
+}
+
+type URINatsData struct {
+	URI string `json:"URI" jsonschema:"pattern=^(nats|tls)://"`
+}
+
+// S3Data identifies a bucket. Endpoint is only needed for s3 compatible
+// services other than aws.
+type S3Data struct {
+	Bucket   string `json:"BUCKET"`
+	Region   string `json:"REGION"`
+	Endpoint string `json:"ENDPOINT,omitempty" jsonschema:"pattern=^https://"`
+}
+
+type URISmtpData struct {
+	URI string `json:"URI" jsonschema:"pattern=^smtps?://"`
+}
+
+type URIGrpcData struct {
+	URI string `json:"URI" jsonschema:"pattern=^grpcs?://"`
+}
+
 const (
 	ProtoHttps       ProtoType = "https"
 	ProtoRediss      ProtoType = "rediss"
 	ProtoPostgresqls ProtoType = "postgresqls"
+	ProtoMysql       ProtoType = "mysql"
+	ProtoMongodb     ProtoType = "mongodb"
+	ProtoAmqps       ProtoType = "amqps"
+	ProtoKafka       ProtoType = "kafka"
+	ProtoNats        ProtoType = "nats"
+	ProtoS3          ProtoType = "s3"
+	ProtoSmtp        ProtoType = "smtp"
+	ProtoGrpc        ProtoType = "grpc"
 )
 
 var ProtoPipeTypes = map[ProtoType][2]any{
 	ProtoHttps:       {nil, &URIHttpsData{}},
 	ProtoRediss:      {nil, &URIRedissData{}},
 	ProtoPostgresqls: {nil, &URIPostgresqlsData{}},
+	ProtoMysql:       {nil, &URIMysqlData{}},
+	ProtoMongodb:     {nil, &URIMongodbData{}},
+	ProtoAmqps:       {nil, &URIAmqpsData{}},
+	ProtoKafka:       {nil, &KafkaData{}},
+	ProtoNats:        {nil, &URINatsData{}},
+	ProtoS3:          {nil, &S3Data{}},
+	ProtoSmtp:        {nil, &URISmtpData{}},
+	ProtoGrpc:        {nil, &URIGrpcData{}},
 }
 
 type PipeDefiner interface {
@@ -122,28 +228,56 @@ func NewTemplate(provider bool, t PipeDefiner, data any) *PipeTemplate {
 		log.Error(err)
 	}
 	return &PipeTemplate{
-		ID:    t,
-		This:  thisSchema,
-		Other: otherSchema,
-		data:  data,
+		ID:       t,
+		This:     thisSchema,
+		Other:    otherSchema,
+		data:     data,
+		provider: provider,
 	}
 }
 
 type PipeTemplate struct {
-	ID    PipeDefiner        `json:"id"`
-	This  *jsonschema.Schema `json:"this,omitempty"`
-	Other *jsonschema.Schema `json:"other,omitempty"`
-	data  any                `json:"-"`
+	ID       PipeDefiner        `json:"id"`
+	This     *jsonschema.Schema `json:"this,omitempty"`
+	Other    *jsonschema.Schema `json:"other,omitempty"`
+	data     any                `json:"-"`
+	provider bool               `json:"-"`
+	// command that creates generated credentials on the resource
+	provision string
+}
+
+// ValidateData checks the template data against the schema for this end.
+// Templates usually only provide part of the data so required fields are not
+// enforced.
+func (t *PipeTemplate) ValidateData() error {
+	if t.data == nil {
+		return nil
+	}
+	e := End{}
+	if t.This != nil {
+		schema := *t.This
+		schema.Required = nil
+		e.Schema = &schema
+	}
+	if proto, ok := t.ID.(ProtoType); ok {
+		e.protos = []ProtoType{proto}
+	}
+	if err := e.SetData(t.data); err != nil {
+		return err
+	}
+	return e.Validate()
 }
 
 type Blueprint struct {
-	Name            string              `json:"name"`
-	Adapters        []*PipeTemplate     `json:"adapters"`
-	DefaultAdapters []AdapterType       `json:"defaultAdapters"`
-	Protos          []*PipeTemplate     `json:"protos"`
-	MaxPipes        int                 `json:"maxPipes"`
-	pipes           map[string]struct{} `json:"-"`
-	mutex           sync.RWMutex        `json:"-"`
+	Name            string          `json:"name"`
+	Adapters        []*PipeTemplate `json:"adapters"`
+	DefaultAdapters []AdapterType   `json:"defaultAdapters"`
+	Protos          []*PipeTemplate `json:"protos"`
+	MaxPipes        int             `json:"maxPipes"`
+	// Retired blueprints reject new bindings but keep their existing pipes
+	Retired bool                `json:"retired,omitempty"`
+	pipes   map[string]struct{} `json:"-"`
+	mutex   sync.RWMutex        `json:"-"`
 }
 
 func NewBlueprint(name string, defaultAdapters []AdapterType, adapters []*PipeTemplate, protos []*PipeTemplate, maxPipes int) *Blueprint {
@@ -169,6 +303,115 @@ type Binding struct {
 	Pipe
 	Adapters []AdapterType `json:"adapters"`
 	Proto    ProtoType     `json:"proto"`
+	// Acceptable adapter sets and protos in order of preference. They are
+	// only used if Adapters or Proto are not specified.
+	AdapterSets [][]AdapterType `json:"adapterSets,omitempty"`
+	Protos      []ProtoType     `json:"protos,omitempty"`
+}
+
+type SupportedTypes struct {
+	Adapters        []AdapterType `json:"adapters"`
+	DefaultAdapters []AdapterType `json:"defaultAdapters"`
+	Protos          []ProtoType   `json:"protos"`
+}
+
+// NegotiationError is returned when none of the requested adapter sets or
+// protos are supported by the blueprint
+type NegotiationError struct {
+	Message     string          `json:"error"`
+	AdapterSets [][]AdapterType `json:"adapterSets,omitempty"`
+	Protos      []ProtoType     `json:"protos,omitempty"`
+	Supported   SupportedTypes  `json:"supported"`
+}
+
+func (e *NegotiationError) Error() string {
+	return e.Message
+}
+
+func (s *Blueprint) Supported() SupportedTypes {
+	supported := SupportedTypes{
+		Adapters:        []AdapterType{},
+		DefaultAdapters: s.DefaultAdapters,
+		Protos:          []ProtoType{},
+	}
+	if supported.DefaultAdapters == nil {
+		supported.DefaultAdapters = []AdapterType{}
+	}
+	for _, t := range s.Adapters {
+		supported.Adapters = append(supported.Adapters, t.ID.(AdapterType))
+	}
+	for _, t := range s.Protos {
+		supported.Protos = append(supported.Protos, t.ID.(ProtoType))
+	}
+	return supported
+}
+
+// Negotiate selects the first adapter set and the first proto requested by
+// the binding that are supported by the blueprint. On success it sets the
+// Adapters and Proto of the binding and returns the templates to apply.
+func (s *Blueprint) Negotiate(b *Binding) ([]*PipeTemplate, error) {
+	sets := b.AdapterSets
+	if len(b.Adapters) > 0 {
+		sets = [][]AdapterType{b.Adapters}
+	} else if len(sets) == 0 {
+		sets = [][]AdapterType{s.DefaultAdapters}
+	}
+	protos := b.Protos
+	if b.Proto != "" {
+		protos = []ProtoType{b.Proto}
+	} else if len(protos) == 0 && len(s.Protos) > 0 {
+		protos = []ProtoType{s.Protos[0].ID.(ProtoType)}
+	}
+	fail := func(format string, a ...any) error {
+		return &NegotiationError{
+			Message:     fmt.Sprintf(format, a...),
+			AdapterSets: sets,
+			Protos:      protos,
+			Supported:   s.Supported(),
+		}
+	}
+
+	adapters := []AdapterType{}
+	templates := []*PipeTemplate{}
+	missing := []AdapterType{}
+	found := false
+outer:
+	for _, set := range sets {
+		adapters = []AdapterType{}
+		templates = []*PipeTemplate{}
+		for _, want := range set {
+			t := s.findTemplate(s.Adapters, want)
+			if t == nil {
+				missing = append(missing, want)
+				continue outer
+			}
+			adapters = append(adapters, want)
+			templates = append(templates, t)
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fail("No supported adapter set, adapters '%v' not found", missing)
+	}
+
+	for _, want := range protos {
+		if t := s.findTemplate(s.Protos, want); t != nil {
+			b.Adapters = adapters
+			b.Proto = want
+			return append(templates, t), nil
+		}
+	}
+	return nil, fail("No supported proto, protos '%v' not found", protos)
+}
+
+func (s *Blueprint) findTemplate(templates []*PipeTemplate, id PipeDefiner) *PipeTemplate {
+	for _, t := range templates {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
 }
 
 func (s *Blueprint) AddPipe(id string) bool {
@@ -192,18 +435,49 @@ func (s *Blueprint) DeletePipe(id string) {
 	delete(s.pipes, id)
 }
 
+func (s *Blueprint) PipeCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.pipes)
+}
+
+// adopt takes over the pipes of a blueprint that is being replaced so they
+// still count against MaxPipes
+func (s *Blueprint) adopt(old *Blueprint) {
+	old.mutex.RLock()
+	defer old.mutex.RUnlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id := range old.pipes {
+		s.pipes[id] = struct{}{}
+	}
+}
+
 type End struct {
 	Issuer string             `json:"issuer,omitempty"`
 	URI    string             `json:"uri,omitempty"`
 	Schema *jsonschema.Schema `json:"schema,omitempty"`
 	Data   json.RawMessage    `json:"data,omitempty"`
+	// protos the data is checked against beyond the schema
+	protos []ProtoType `json:"-"`
+	// how this end gets the data of the other end, push or pull
+	Delivery string `json:"delivery,omitempty"`
 }
 
+const (
+	// the other end sends its data whenever it changes
+	deliveryPush = "push"
+	// this end fetches the data of the other end, for ends that the other
+	// end can't reach
+	deliveryPull = "pull"
+)
+
 func (e *End) Equals(other End) bool {
 	return e.Issuer == other.Issuer &&
 		e.URI == other.URI &&
 		(e.Schema == other.Schema || (e.Schema != nil && other.Schema != nil && e.Schema.ID == other.Schema.ID)) &&
-		bytes.Equal(e.Data, other.Data)
+		bytes.Equal(e.Data, other.Data) &&
+		e.Delivery == other.Delivery
 }
 
 const schemaVersion = "https://json-schema.org/draft/2020-12/schema"
@@ -217,6 +491,12 @@ func generateSchema(items []any) (*jsonschema.Schema, error) {
 		if item == nil {
 			continue
 		}
+		if schema, ok := item.(*jsonschema.Schema); ok {
+			// already a schema, e.g. from a plugin
+			c := *schema
+			schemas = append(schemas, &c)
+			continue
+		}
 		s := reflector.Reflect(item)
 		s.AdditionalProperties = nil
 		schemas = append(schemas, s)
@@ -241,7 +521,7 @@ func combineSchemas(items []*jsonschema.Schema) (*jsonschema.Schema, error) {
 	if len(filtered) == 1 {
 		schema = filtered[0]
 	} else {
-		log.Errorf("Multiple Items %+v", filtered)
+		log.Debugf("Multiple Items %+v", filtered)
 		for _, item := range filtered {
 			item.Version = ""
 		}
@@ -290,7 +570,25 @@ func (e *End) SetData(d any) error {
 }
 
 func (e *End) Validate() error {
-	if e.Schema == nil || isJSONEmpty(e.Data) {
+	if e.Delivery != "" && e.Delivery != deliveryPush && e.Delivery != deliveryPull {
+		return fmt.Errorf("Invalid delivery '%s'", e.Delivery)
+	}
+	if isJSONEmpty(e.Data) {
+		return nil
+	}
+	if err := e.validateSchema(); err != nil {
+		return err
+	}
+	for _, proto := range e.protos {
+		if err := validateProtoData(proto, e.Data); err != nil {
+			return fmt.Errorf("Data is not valid for proto '%s': %w", proto, err)
+		}
+	}
+	return nil
+}
+
+func (e *End) validateSchema() error {
+	if e.Schema == nil {
 		return nil
 	}
 
@@ -328,6 +626,9 @@ func (e *End) Merge(o *End) error {
 	if err != nil {
 		return err
 	}
+	if o.Delivery != "" {
+		e.Delivery = o.Delivery
+	}
 	return nil
 }
 
@@ -349,9 +650,26 @@ type Pipe struct {
 	This      End        `json:"this,omitempty"`
 	Other     End        `json:"other,omitempty"`
 	Links     Links      `json:"_links"`
+	PeerState string     `json:"peerState,omitempty"` // set when the other end is deleted
 	blueprint *Blueprint `json:"-"`
+	// templates the pipe was created from, used when rotating
+	templates []*PipeTemplate `json:"-"`
+	// generated values that are never shared with the other end
+	secrets map[string]string `json:"-"`
+	// data from a deleted other end whose config should be removed
+	staleOther json.RawMessage `json:"-"`
+	// delivery status, shared by copies of the pipe
+	Status *PipeStatus `json:"-"`
+	// the last update applied from the other end
+	inboundSequence uint64
+	inboundKey      string
 }
 
+const (
+	peerDisconnected = "disconnected"
+	peerOrphaned     = "orphaned"
+)
+
 func (p *Pipe) Validate() error {
 	if err := p.This.Validate(); err != nil {
 		return err
@@ -363,6 +681,14 @@ func (p *Pipe) Validate() error {
 }
 
 func (p *Pipe) Merge(o *Pipe) error {
+	// the location of this end is set by the server, but the location of
+	// the other end can be filled in after the pipe is created
+	if o.Other.URI != "" {
+		p.Other.URI = o.Other.URI
+	}
+	if o.Other.Issuer != "" {
+		p.Other.Issuer = o.Other.Issuer
+	}
 	if err := p.This.Merge(&o.This); err != nil {
 		return err
 	}
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/invopop/jsonschema"
+)
+
+// External adapters are executables in the plugins directory that speak json
+// over stdin and stdout. Each plugin is run with a single argument naming the
+// event. For "describe" it is run without input and prints a
+// pluginDescription. For every other event it reads a pluginEvent and prints a
+// pluginResponse.
+
+const (
+	pluginDescribe = "describe"
+	pluginBind     = "bind"
+	pluginUpdate   = "update"
+	pluginRotate   = "rotate"
+	pluginUnbind   = "unbind"
+)
+
+const pluginTimeout = 30 * time.Second
+
+// pluginDescription is the schema of the data each end of a pipe provides,
+// using the same layout as AuthPipeTypes: "this" is the data provided by the
+// end that needs the resource and "other" is the data provided by the end that
+// offers it.
+type pluginDescription struct {
+	ID    AdapterType        `json:"id"`
+	This  *jsonschema.Schema `json:"this,omitempty"`
+	Other *jsonschema.Schema `json:"other,omitempty"`
+}
+
+type pluginEvent struct {
+	Event    string      `json:"event"`
+	Adapter  AdapterType `json:"adapter"`
+	Provider bool        `json:"provider"`
+	Pipe     *Pipe       `json:"pipe"`
+	Data     any         `json:"data,omitempty"`
+}
+
+type pluginResponse struct {
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type pluginHandler struct {
+	ID   AdapterType
+	Path string
+}
+
+// adapters loaded from plugins or definitions
+var customAdapters = []AdapterType{}
+
+func runPlugin(path string, event string, input any) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, event)
+	cmd.Dir = filepath.Dir(path)
+	if input != nil {
+		inputJson, err := json.Marshal(input)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling JSON: %w", err)
+		}
+		cmd.Stdin = bytes.NewReader(inputJson)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s %s failed: %w: %s", path, event, err, stderr.String())
+	}
+	return output, nil
+}
+
+func (h *pluginHandler) send(event string, p *Pipe, t *PipeTemplate) error {
+	output, err := runPlugin(h.Path, event, &pluginEvent{
+		Event:    event,
+		Adapter:  h.ID,
+		Provider: t.provider,
+		Pipe:     p,
+		Data:     t.data,
+	})
+	if err != nil {
+		return err
+	}
+	var resp pluginResponse
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return fmt.Errorf("invalid response from plugin %s: %w", h.ID, err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("plugin %s: %s", h.ID, resp.Error)
+	}
+	if isJSONEmpty(resp.Data) {
+		return nil
+	}
+	return p.This.SetData(resp.Data)
+}
+
+func (h *pluginHandler) Bind(p *Pipe, t *PipeTemplate) error {
+	return h.send(pluginBind, p, t)
+}
+
+func (h *pluginHandler) Update(p *Pipe, t *PipeTemplate) error {
+	return h.send(pluginUpdate, p, t)
+}
+
+func (h *pluginHandler) Rotate(p *Pipe, t *PipeTemplate) error {
+	return h.send(pluginRotate, p, t)
+}
+
+func (h *pluginHandler) Unbind(p *Pipe, t *PipeTemplate) error {
+	return h.send(pluginUnbind, p, t)
+}
+
+// loadPlugins registers every executable in dir as an adapter
+func loadPlugins(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading plugins directory: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		output, err := runPlugin(path, pluginDescribe, nil)
+		if err != nil {
+			return err
+		}
+		var desc pluginDescription
+		if err := json.Unmarshal(output, &desc); err != nil {
+			return fmt.Errorf("invalid description from plugin %s: %w", path, err)
+		}
+		if desc.ID == "" {
+			return fmt.Errorf("plugin %s did not describe an id", path)
+		}
+		if _, ok := AuthPipeTypes[desc.ID]; ok {
+			return fmt.Errorf("plugin %s redefines adapter '%s'", path, desc.ID)
+		}
+		log.Infof("Adding adapter %s from plugin %s", desc.ID, path)
+		AuthPipeTypes[desc.ID] = schemaTypes(desc.This, desc.Other)
+		AdapterHandlers[desc.ID] = &pluginHandler{ID: desc.ID, Path: path}
+		customAdapters = append(customAdapters, desc.ID)
+	}
+	return nil
+}
+
+// customAdapterTemplates returns a template for every adapter loaded from
+// plugins or definitions
+func customAdapterTemplates(provider bool) []*PipeTemplate {
+	templates := []*PipeTemplate{}
+	for _, id := range customAdapters {
+		templates = append(templates, NewTemplate(provider, id, nil))
+	}
+	return templates
+}
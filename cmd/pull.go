@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Pipes that pull fetch the data of the other end instead of waiting for it
+// to be sent, for brokers that the other end can't reach. The other end holds
+// the request open until its data changes, and conditional requests keep
+// fetches of unchanged data cheap.
+
+const (
+	maxPullWait = 5 * time.Minute
+	// how often to look for pipes that should start pulling
+	pullScanInterval = 1 * time.Second
+)
+
+// pipeETag identifies the version of this end of a pipe
+func pipeETag(p *Pipe) string {
+	content, err := json.Marshal(End{URI: p.This.URI, Issuer: p.This.Issuer, Data: p.This.Data})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16]))
+}
+
+// readPipeConditional reads a pipe, returning 304 if If-None-Match matches
+// the current version of this end. With ?wait= the request is held until
+// this end changes or the wait is over.
+func readPipeConditional(resource *Resource, pid string, w http.ResponseWriter, r *http.Request) {
+	var wait time.Duration
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		var err error
+		if wait, err = time.ParseDuration(raw); err != nil || wait < 0 {
+			http.Error(w, fmt.Sprintf("Invalid wait '%s'", raw), http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, maxPullWait)
+	}
+	match := r.Header.Get("If-None-Match")
+	var ch chan *PipeEvent
+	if match != "" && wait > 0 {
+		// subscribe before reading so no change is missed
+		ch, _, _ = events.subscribe(0, false)
+		defer events.unsubscribe(ch)
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		resource.Mutex.RLock()
+		p, ok := resource.Pipes[pid]
+		if !ok {
+			resource.Mutex.RUnlock()
+			http.Error(w, fmt.Sprintf("Pipe '%s' not found", pid), http.StatusNotFound)
+			return
+		}
+		etag := pipeETag(p)
+		status := p.Status
+		if match == "" || match != etag {
+			w.Header().Set("ETag", etag)
+			readPipe(p, w)
+			resource.Mutex.RUnlock()
+			pulled(r, status)
+			return
+		}
+		resource.Mutex.RUnlock()
+		if ch == nil {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			pulled(r, status)
+			return
+		}
+		// wait for an event for the pipe and check again
+		changed := false
+		for !changed {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-deadline.C:
+				w.Header().Set("ETag", etag)
+				w.WriteHeader(http.StatusNotModified)
+				pulled(r, status)
+				return
+			case e, ok := <-ch:
+				if !ok {
+					// dropped by the hub, so stop waiting
+					ch = nil
+					changed = true
+				} else if e.Resource == resource.ID && e.PipeID == pid {
+					changed = true
+				}
+			}
+		}
+	}
+}
+
+// pulled records that the other end has the current version of this end
+func pulled(r *http.Request, status *PipeStatus) {
+	if fromPeer(r) {
+		status.attempt()
+		status.sent(nil, 0)
+	}
+}
+
+// puller runs a fetch loop for each pipe that pulls
+type puller struct {
+	mutex    sync.Mutex
+	running  map[string]bool
+	registry *Registry
+	sc       *ServerConfig
+	interval time.Duration
+	wait     time.Duration
+	client   *http.Client
+}
+
+func startPuller(registry *Registry, sc *ServerConfig, interval, wait time.Duration) {
+	pl := &puller{
+		running:  map[string]bool{},
+		registry: registry,
+		sc:       sc,
+		interval: interval,
+		wait:     wait,
+		client:   &http.Client{Timeout: wait + 10*time.Second},
+	}
+	go func() {
+		for {
+			pl.scan()
+			time.Sleep(pullScanInterval)
+		}
+	}()
+}
+
+// scan starts a loop for any pipe that pulls and doesn't have one yet
+func (pl *puller) scan() {
+	for _, resource := range pl.registry.List() {
+		resource.Mutex.RLock()
+		for pid, p := range resource.Pipes {
+			if p.This.Delivery != deliveryPull || p.Other.URI == "" {
+				continue
+			}
+			key := fmt.Sprintf("%s/%s", resource.ID, pid)
+			pl.mutex.Lock()
+			if !pl.running[key] {
+				pl.running[key] = true
+				go pl.run(key, resource, pid)
+			}
+			pl.mutex.Unlock()
+		}
+		resource.Mutex.RUnlock()
+	}
+}
+
+// run fetches the other end of a pipe until the pipe stops pulling
+func (pl *puller) run(key string, resource *Resource, pid string) {
+	defer func() {
+		pl.mutex.Lock()
+		delete(pl.running, key)
+		pl.mutex.Unlock()
+	}()
+	etag := ""
+	failures := 0
+	for {
+		resource.Mutex.RLock()
+		p, ok := resource.Pipes[pid]
+		if ok && (p.This.Delivery != deliveryPull || p.Other.URI == "") {
+			ok = false
+		}
+		var this End
+		var otherURI string
+		var status *PipeStatus
+		if ok {
+			this, otherURI, status = p.This, p.Other.URI, p.Status
+		}
+		resource.Mutex.RUnlock()
+		if !ok {
+			return
+		}
+		if _, ok := pl.registry.Get(resource.ID); !ok {
+			return
+		}
+
+		start := time.Now()
+		status.attempt()
+		remote, newETag, err := pl.fetch(otherURI, this.URI, etag)
+		if err != nil {
+			failures++
+			status.sent(err, failures)
+			delay := backoff(failures)
+			log.Infof("Retrying pull for %s in %v due to error: %v", key, delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		failures = 0
+		status.sent(nil, 0)
+		if remote != nil {
+			if err := pl.apply(resource, pid, otherURI, remote); err != nil {
+				log.Errorf("Error applying pulled data for %s: %v", key, err)
+			} else {
+				etag = newETag
+			}
+		}
+		if elapsed := time.Since(start); elapsed < pl.interval {
+			time.Sleep(pl.interval - elapsed)
+		}
+	}
+}
+
+// fetch reads the other end, returning nil if it hasn't changed since etag
+func (pl *puller) fetch(uri, subject, etag string) (*Pipe, string, error) {
+	token, err := generateToken(pl.sc.Prefix, uri, subject)
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	if pl.wait > 0 && etag != "" {
+		q := u.Query()
+		q.Set("wait", pl.wait.String())
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := pl.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("invalid response status: %s", resp.Status)
+	}
+	var remote Pipe
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		return nil, "", fmt.Errorf("invalid response: %w", err)
+	}
+	return &remote, resp.Header.Get("ETag"), nil
+}
+
+// apply stores the data of the other end as if it had been sent to us
+func (pl *puller) apply(resource *Resource, pid, otherURI string, remote *Pipe) error {
+	resource.Mutex.Lock()
+	defer resource.Mutex.Unlock()
+	existing, ok := resource.Pipes[pid]
+	if !ok || existing.Other.URI != otherURI {
+		// changed while fetching
+		return nil
+	}
+	if resource.pipeBusy(pid) {
+		return fmt.Errorf("pipe is busy")
+	}
+	// local copy of existing pipe, including its secrets
+	p := *existing
+	p.secrets = maps.Clone(existing.secrets)
+	input := Pipe{Other: End{Data: remote.This.Data}}
+	reconnected, _, err := mergeUpdate(resource, &p, &input, true)
+	if err != nil {
+		return err
+	}
+	if reconnected {
+		log.Infof("Other end of pipe %s/%s reconnected", resource.ID, pid)
+	}
+	applyPipe(resource, &p, existing.This, existing.Other, pl.sc)
+	if reconnected {
+		// the other end may have been recreated without our data
+		maybeUpdateOther(&p, pl.sc)
+	}
+	return nil
+}
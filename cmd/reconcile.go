@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The reconciler repairs pipes whose other end missed an update. It
+// periodically reads what the other end of each linked pipe has for its other
+// end and pushes this end again if it is out of date.
+
+// peerHandler returns the other end of the pipe as seen by this broker, so the
+// broker on the other end can check that it has the latest data
+func peerHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pid := r.PathValue("pid")
+	p, ok := resource.Pipes[pid]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Pipe '%s' not found", pid), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, End{URI: p.Other.URI, Issuer: p.Other.Issuer, Data: p.Other.Data, Delivery: p.Other.Delivery})
+}
+
+// reconcileTarget is a snapshot of a linked pipe
+type reconcileTarget struct {
+	resource *Resource
+	pid      string
+	this     End
+	other    string
+}
+
+func startReconciler(registry *Registry, sc *ServerConfig, interval time.Duration, concurrency int) {
+	if interval <= 0 {
+		return
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			reconcile(registry, sc, concurrency)
+		}
+	}()
+}
+
+// reconcile checks every linked pipe once, with at most concurrency requests
+// to each peer at a time
+func reconcile(registry *Registry, sc *ServerConfig, concurrency int) {
+	targets := []reconcileTarget{}
+	for _, resource := range registry.List() {
+		resource.Mutex.RLock()
+		for pid, p := range resource.Pipes {
+			if !pushesToOther(p) {
+				continue
+			}
+			targets = append(targets, reconcileTarget{resource, pid, p.This, p.Other.URI})
+		}
+		resource.Mutex.RUnlock()
+	}
+	peers := map[string]chan struct{}{}
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		if outbox.Pending(t.this.URI) {
+			// an update is already on its way
+			continue
+		}
+		peer := t.other
+		if u, err := url.Parse(t.other); err == nil {
+			peer = u.Host
+		}
+		if _, ok := peers[peer]; !ok {
+			peers[peer] = make(chan struct{}, concurrency)
+		}
+		sem := peers[peer]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			reconcilePipe(t, sc)
+		}()
+	}
+	wg.Wait()
+}
+
+func reconcilePipe(t reconcileTarget, sc *ServerConfig) {
+	seen, err := fetchPeerView(sc.Prefix, t.other, t.this.URI)
+	if err != nil {
+		log.Warnf("Error reading other end of %s: %v", t.this.URI, err)
+		return
+	}
+	if seen.URI == t.this.URI && seen.Delivery == t.this.Delivery && sameJSON(seen.Data, t.this.Data) {
+		return
+	}
+	log.Infof("Other end of %s is out of date, sending update", t.this.URI)
+	t.resource.Mutex.RLock()
+	defer t.resource.Mutex.RUnlock()
+	p, ok := t.resource.Pipes[t.pid]
+	if !ok || p.Other.URI != t.other || !p.This.Equals(t.this) {
+		// changed since the snapshot, so an update was already sent
+		return
+	}
+	maybeUpdateOther(p, sc)
+}
+
+// fetchPeerView reads what the pipe at uri has for its other end
+func fetchPeerView(issuer, uri, subject string) (*End, error) {
+	token, err := generateToken(issuer, uri, subject)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/peer", uri), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	resp, err := brokerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid response status: %s", resp.Status)
+	}
+	var seen End
+	if err := json.NewDecoder(resp.Body).Decode(&seen); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &seen, nil
+}
+
+// sameJSON compares two json values ignoring formatting and key order
+func sameJSON(a, b json.RawMessage) bool {
+	if isJSONEmpty(a) || isJSONEmpty(b) {
+		return isJSONEmpty(a) == isJSONEmpty(b)
+	}
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
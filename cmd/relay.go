@@ -0,0 +1,431 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A broker behind NAT can't receive requests from other brokers. Instead it
+// connects to a relay broker and uses the relay url as its prefix. The relay
+// forwards requests for that prefix over the connection and sends back the
+// responses. Each name has its own credentials for the connection. The relay
+// doesn't authenticate forwarded requests, tokens are validated by the broker
+// behind the relay.
+
+const (
+	// how long a connection waits for a request before reconnecting
+	relayWait = 30 * time.Second
+	// how long a forwarded request waits for a response
+	relayTimeout = 60 * time.Second
+)
+
+// relayedHeaders are copied between the relay and the broker behind it
+var relayedHeaders = []string{"Authorization", "Content-Type", "Accept", "If-None-Match", "ETag", "Location", "Last-Event-ID", sequenceHeader, idempotencyHeader, ignoredHeader}
+
+type RelayRequest struct {
+	ID     string            `json:"id"`
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Query  string            `json:"query,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+}
+
+// RelayCredentials let one broker connect to the relay under its name
+type RelayCredentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// the url to start the broker with, including the credentials
+	URL string `json:"url"`
+}
+
+type RelayResponse struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+}
+
+// tunnel holds the requests for one broker behind the relay
+type tunnel struct {
+	requests chan *RelayRequest
+	// responses for requests that have been forwarded, by id
+	pending map[string]chan *RelayResponse
+	// when the broker last asked for a request
+	lastSeen time.Time
+}
+
+type relayHub struct {
+	mutex   sync.Mutex
+	tunnels map[string]*tunnel
+	// passwords of the brokers behind the relay, by name
+	passwords map[string]string
+}
+
+var relays = &relayHub{tunnels: map[string]*tunnel{}, passwords: map[string]string{}}
+
+// authorized returns true if the request has the credentials for name
+func (h *relayHub) authorized(name string, r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != name {
+		return false
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	expected, ok := h.passwords[name]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1
+}
+
+// connected returns the tunnel for name if the broker has asked for requests
+// recently
+func (h *relayHub) connected(name string) (*tunnel, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	t, ok := h.tunnels[name]
+	if !ok || time.Since(t.lastSeen) > relayWait+10*time.Second {
+		return nil, false
+	}
+	return t, true
+}
+
+func (h *relayHub) tunnel(name string) *tunnel {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	t, ok := h.tunnels[name]
+	if !ok {
+		t = &tunnel{
+			requests: make(chan *RelayRequest),
+			pending:  map[string]chan *RelayResponse{},
+		}
+		h.tunnels[name] = t
+	}
+	return t
+}
+
+func copyHeaders(get func(string) string) map[string]string {
+	header := map[string]string{}
+	for _, k := range relayedHeaders {
+		if v := get(k); v != "" {
+			header[k] = v
+		}
+	}
+	return header
+}
+
+// relayCredentialsHandler creates new credentials for a broker behind the
+// relay, replacing any it had
+func relayCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	password, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sc := r.Context().Value(configKey).(ServerConfig)
+	u, err := url.Parse(fmt.Sprintf("%s/relay/%s", sc.Prefix, url.PathEscape(name)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.User = url.UserPassword(name, password)
+	relays.mutex.Lock()
+	relays.passwords[name] = password
+	relays.mutex.Unlock()
+	log.Infof("Created relay credentials for %s", name)
+	writeJSON(w, http.StatusCreated, RelayCredentials{Name: name, Password: password, URL: u.String()})
+}
+
+// relayConnectHandler hands the next request for the broker to it, or returns
+// 204 if there is none before the wait is over
+func relayConnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !relays.authorized(name, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	t := relays.tunnel(name)
+	relays.mutex.Lock()
+	t.lastSeen = time.Now()
+	relays.mutex.Unlock()
+	defer func() {
+		relays.mutex.Lock()
+		t.lastSeen = time.Now()
+		relays.mutex.Unlock()
+	}()
+	select {
+	case req := <-t.requests:
+		writeJSON(w, http.StatusOK, req)
+	case <-time.After(relayWait):
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
+
+// relayResponseHandler receives the response to a forwarded request
+func relayResponseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	if !relays.authorized(name, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var resp RelayResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := relays.tunnel(name)
+	rid := r.PathValue("rid")
+	relays.mutex.Lock()
+	ch, ok := t.pending[rid]
+	delete(t.pending, rid)
+	relays.mutex.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Request '%s' not found", rid), http.StatusNotFound)
+		return
+	}
+	ch <- &resp
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// relayedRoute returns true for the requests that other brokers send to a
+// broker behind the relay. The management api of the broker is not exposed.
+func relayedRoute(method, p string) bool {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if slices.ContainsFunc(parts, func(part string) bool {
+		return part == "" || part == "." || part == ".."
+	}) {
+		return false
+	}
+	switch {
+	case len(parts) == 2 && parts[0] == ".well-known":
+		return method == http.MethodGet && (parts[1] == "openid-configuration" || parts[1] == "jwks.json")
+	case len(parts) == 3 && parts[1] == "pipes" && parts[2] != "events":
+		return method == http.MethodGet || method == http.MethodPatch || method == http.MethodDelete
+	case len(parts) == 4 && parts[1] == "pipes" && parts[3] == "peer":
+		return method == http.MethodGet
+	case len(parts) == 5 && parts[1] == "offers" && parts[3] == "invitations" && parts[4] == "redeem":
+		// authenticated by the invitation
+		return method == http.MethodPost
+	}
+	return false
+}
+
+// relayProxyHandler forwards a request to the broker behind the relay
+func relayProxyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !relayedRoute(r.Method, "/"+r.PathValue("path")) {
+		http.Error(w, "Only requests from other brokers are relayed", http.StatusForbidden)
+		return
+	}
+	t, ok := relays.connected(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Broker '%s' is not connected", name), http.StatusBadGateway)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := randomID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req := &RelayRequest{
+		ID:     id,
+		Method: r.Method,
+		Path:   "/" + r.PathValue("path"),
+		Query:  r.URL.RawQuery,
+		Header: copyHeaders(r.Header.Get),
+		Body:   body,
+	}
+	ch := make(chan *RelayResponse, 1)
+	relays.mutex.Lock()
+	t.pending[id] = ch
+	relays.mutex.Unlock()
+	defer func() {
+		relays.mutex.Lock()
+		delete(t.pending, id)
+		relays.mutex.Unlock()
+	}()
+
+	timeout := time.NewTimer(relayTimeout)
+	defer timeout.Stop()
+	select {
+	case t.requests <- req:
+	case <-timeout.C:
+		http.Error(w, fmt.Sprintf("Broker '%s' is not connected", name), http.StatusBadGateway)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	select {
+	case resp := <-ch:
+		for k, v := range resp.Header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+	case <-timeout.C:
+		http.Error(w, fmt.Sprintf("Broker '%s' did not respond", name), http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+	}
+}
+
+// relayPrefix returns the prefix for a broker behind the relay at rawURL,
+// without any credentials
+func relayPrefix(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid relay url '%s': %w", rawURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" || !strings.HasPrefix(u.Path, "/relay/") {
+		return "", fmt.Errorf("relay url '%s' is not a /relay/{name} url", rawURL)
+	}
+	u.User = nil
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// connectRelay forwards requests from the relay at rawURL to handler until
+// the broker stops
+func connectRelay(rawURL string, handler http.Handler) {
+	base := strings.TrimSuffix(rawURL, "/")
+	client := &http.Client{Timeout: relayWait + 10*time.Second}
+	failures := 0
+	for {
+		req, err := nextRelayRequest(client, base)
+		if err != nil {
+			failures++
+			delay := backoff(failures)
+			log.Warnf("Error connecting to relay, retrying in %v: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		failures = 0
+		if req != nil {
+			go serveRelayRequest(client, base, req, handler)
+		}
+	}
+}
+
+// nextRelayRequest waits for a request from the relay, returning nil if there
+// was none
+func nextRelayRequest(client *http.Client, base string) (*RelayRequest, error) {
+	httpReq, err := brokerRequest(http.MethodGet, base+"/_connect", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("invalid response status: %s", resp.Status)
+	}
+	var req RelayRequest
+	if err := json.NewDecoder(resp.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("invalid request from relay: %w", err)
+	}
+	return &req, nil
+}
+
+// relayResponseWriter collects the response to a request from the relay. It
+// can't flush, so event streams refuse to run through it.
+type relayResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *relayResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *relayResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *relayResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// serveRelayRequest runs a request from the relay and sends back the
+// response. The request gets as long as the relay waits for the response.
+func serveRelayRequest(client *http.Client, base string, req *RelayRequest, handler http.Handler) {
+	target := req.Path
+	if req.Query != "" {
+		target += "?" + req.Query
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), relayTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, target, bytes.NewReader(req.Body))
+	if err != nil {
+		log.Errorf("Invalid request from relay: %v", err)
+		return
+	}
+	for k, v := range req.Header {
+		httpReq.Header.Set(k, v)
+	}
+	recorder := &relayResponseWriter{header: http.Header{}}
+	if relayedRoute(req.Method, req.Path) {
+		handler.ServeHTTP(recorder, httpReq)
+	} else {
+		// the relay should not have sent it
+		http.Error(recorder, "Only requests from other brokers are relayed", http.StatusForbidden)
+	}
+	if recorder.status == 0 {
+		// the handler gave up, e.g. a ?wait= longer than the relay waits
+		recorder.status = http.StatusGatewayTimeout
+	}
+	resp := RelayResponse{
+		Status: recorder.status,
+		Header: copyHeaders(recorder.Header().Get),
+		Body:   recorder.body.Bytes(),
+	}
+	body, err := json.Marshal(&resp)
+	if err != nil {
+		log.Errorf("Error marshalling json: %v", err)
+		return
+	}
+	httpReq, err = brokerRequest(http.MethodPost, fmt.Sprintf("%s/_responses/%s", base, req.ID), body)
+	if err != nil {
+		log.Errorf("Error sending response to relay: %v", err)
+		return
+	}
+	r, err := client.Do(httpReq)
+	if err != nil {
+		log.Errorf("Error sending response to relay: %v", err)
+		return
+	}
+	r.Body.Close()
+}
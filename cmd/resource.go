@@ -1,15 +1,152 @@
 package cmd
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 type PipeCallback *func(*Pipe) error
 
 type Resource struct {
-	ID             string
-	Needs          []*Blueprint
-	Offers         []*Blueprint
-	Pipes          map[string]*Pipe
-	Mutex          sync.RWMutex
-	DefaultData    any
-	UpdateCallback PipeCallback
+	ID             string           `json:"id"`
+	Needs          []*Blueprint     `json:"needs"`
+	Offers         []*Blueprint     `json:"offers"`
+	Pipes          map[string]*Pipe `json:"pipes"`
+	Mutex          sync.RWMutex     `json:"-"`
+	DefaultData    any              `json:"data,omitempty"`
+	UpdateCallback PipeCallback     `json:"-"`
+	// command run when auth:server credentials change
+	Provision string `json:"provision,omitempty"`
+	// pipes whose adapters are running while the resource is unlocked
+	busy map[string]int
+	// set once the config is known to have no tools manifest
+	noToolsManifest bool
+}
+
+// Registry holds the resources served by a broker. Resources can be added and
+// removed while the broker is running.
+type Registry struct {
+	resources map[string]*Resource
+	mutex     sync.RWMutex
+	// updater is used for the config of resources added at runtime
+	updater configUpdater
+}
+
+func NewRegistry(resources map[string]*Resource, updater configUpdater) *Registry {
+	if resources == nil {
+		resources = map[string]*Resource{}
+	}
+	return &Registry{
+		resources: resources,
+		updater:   updater,
+	}
+}
+
+func (g *Registry) Get(id string) (*Resource, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	r, ok := g.resources[id]
+	return r, ok
+}
+
+// Add registers a resource, returning false if the id is already in use
+func (g *Registry) Add(r *Resource) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.resources[r.ID]; ok {
+		return false
+	}
+	g.resources[r.ID] = r
+	return true
+}
+
+func (g *Registry) Remove(id string) (*Resource, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	r, ok := g.resources[id]
+	if ok {
+		delete(g.resources, id)
+	}
+	return r, ok
+}
+
+// List returns the resources sorted by id
+func (g *Registry) List() []*Resource {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	resources := make([]*Resource, 0, len(g.resources))
+	for _, r := range g.resources {
+		resources = append(resources, r)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].ID < resources[j].ID
+	})
+	return resources
+}
+
+func (r *Resource) blueprints(provider bool) *[]*Blueprint {
+	if provider {
+		return &r.Offers
+	}
+	return &r.Needs
+}
+
+// pruneBlueprints removes retired blueprints that no longer have any pipes
+func (r *Resource) pruneBlueprints() {
+	for _, blueprints := range []*[]*Blueprint{&r.Needs, &r.Offers} {
+		kept := (*blueprints)[:0]
+		for _, s := range *blueprints {
+			if s.Retired && s.PipeCount() == 0 {
+				log.Infof("Removed retired blueprint %s from %s", s.Name, r.ID)
+				continue
+			}
+			kept = append(kept, s)
+		}
+		*blueprints = kept
+	}
+}
+
+// attachProvision passes the provision command of the resource to the
+// auth:server templates of an offer
+func (r *Resource) attachProvision(s *Blueprint) {
+	for _, t := range s.Adapters {
+		if t.ID == ServerAuth {
+			t.provision = r.Provision
+		}
+	}
+}
+
+func (r *Resource) findBlueprint(provider bool, name string) *Blueprint {
+	for _, s := range *r.blueprints(provider) {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// unlockedFor releases the lock the caller holds on the resource while fn
+// runs. The pipes are marked busy meanwhile so nothing else changes them.
+func (r *Resource) unlockedFor(pids []string, fn func() error) error {
+	if r.busy == nil {
+		r.busy = map[string]int{}
+	}
+	for _, pid := range pids {
+		r.busy[pid]++
+	}
+	r.Mutex.Unlock()
+	defer func() {
+		r.Mutex.Lock()
+		for _, pid := range pids {
+			if r.busy[pid]--; r.busy[pid] <= 0 {
+				delete(r.busy, pid)
+			}
+		}
+	}()
+	return fn()
+}
+
+// pipeBusy returns true if the adapters of the pipe are running
+func (r *Resource) pipeBusy(pid string) bool {
+	return r.busy[pid] > 0
 }
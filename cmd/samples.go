@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"embed"
+)
+
+// sample broker configs used by the consumer and provider commands
+//
+//go:embed samples/*.yaml
+var samples embed.FS
+
+func loadSampleConfig(name string) (*BrokerConfig, error) {
+	content, err := samples.ReadFile("samples/" + name + ".yaml")
+	if err != nil {
+		return nil, err
+	}
+	return parseBrokerConfig(content)
+}
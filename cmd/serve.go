@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// serveCmd run a broker from a config file
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Broker from a config file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("invalid command")
+		}
+		return runServe()
+	},
+}
+
+var configPath string
+
+func init() {
+	serveCmd.Flags().StringVar(&configPath, "config", "broker.yaml", "path to broker config file")
+	cmd.AddCommand(serveCmd)
+}
+
+func runServe() error {
+	config, err := loadBrokerConfig(configPath)
+	if err != nil {
+		return err
+	}
+	return runBrokerConfig(config, "8080")
+}
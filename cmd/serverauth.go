@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// serverAuthHandler generates credentials on the end that offers the
+// resource. They are sent to the client through the normal pipe updates.
+// The provision command of the resource creates them on the server.
+type serverAuthHandler struct{}
+
+// provisionEvent is the input of the provision command, which is run with the
+// event as its only argument
+type provisionEvent struct {
+	Event    string `json:"event"`
+	Pipe     string `json:"pipe"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+func (serverAuthHandler) Bind(p *Pipe, t *PipeTemplate) error {
+	if !t.provider {
+		return nil
+	}
+	if err := setServerCredentials(p); err != nil {
+		return err
+	}
+	return provisionCredentials(pluginBind, p, t)
+}
+
+// Update keeps the credentials in the URI if the URI was replaced
+func (serverAuthHandler) Update(p *Pipe, t *PipeTemplate) error {
+	if !t.provider {
+		return nil
+	}
+	var creds ServerAuthData
+	if err := json.Unmarshal(p.This.Data, &creds); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if creds.Username == "" {
+		return nil
+	}
+	return embedCredentials(p, creds)
+}
+
+func (serverAuthHandler) Rotate(p *Pipe, t *PipeTemplate) error {
+	if !t.provider {
+		return nil
+	}
+	if err := setServerCredentials(p); err != nil {
+		return err
+	}
+	return provisionCredentials(pluginRotate, p, t)
+}
+
+func (serverAuthHandler) Unbind(p *Pipe, t *PipeTemplate) error {
+	if !t.provider {
+		return nil
+	}
+	return provisionCredentials(pluginUnbind, p, t)
+}
+
+// provisionCredentials runs the provision command so the credentials of the
+// pipe work on the server. Without a command the credentials have to be
+// created some other way. Like every adapter handler it is called with the
+// resource unlocked, so a slow command only holds up this pipe.
+func provisionCredentials(event string, p *Pipe, t *PipeTemplate) error {
+	if t.provision == "" {
+		return nil
+	}
+	var creds ServerAuthData
+	if err := json.Unmarshal(p.This.Data, &creds); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	input := &provisionEvent{
+		Event:    event,
+		Pipe:     p.ID,
+		Username: creds.Username,
+	}
+	if event != pluginUnbind {
+		input.Password = creds.Password
+	}
+	if _, err := runPlugin(t.provision, event, input); err != nil {
+		return fmt.Errorf("error provisioning credentials: %w", err)
+	}
+	return nil
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// setServerCredentials generates a password for the pipe. The username is
+// the pipe id so it stays stable across rotations. If the pipe carries a
+// URI, the credentials are also embedded in it so the client can use it
+// directly.
+func setServerCredentials(p *Pipe) error {
+	password, err := generatePassword()
+	if err != nil {
+		return err
+	}
+	creds := ServerAuthData{
+		Username: p.ID,
+		Password: password,
+	}
+	if err := p.This.SetData(creds); err != nil {
+		return err
+	}
+	return embedCredentials(p, creds)
+}
+
+// embedCredentials adds the credentials to the URI of the pipe, if it has one
+func embedCredentials(p *Pipe, creds ServerAuthData) error {
+	var data URIData
+	if err := json.Unmarshal(p.This.Data, &data); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if data.URI == "" {
+		return nil
+	}
+	u, err := url.Parse(data.URI)
+	if err != nil {
+		return fmt.Errorf("invalid URI: %w", err)
+	}
+	u.User = url.UserPassword(creds.Username, creds.Password)
+	return p.This.SetData(URIData{URI: u.String()})
+}
@@ -34,31 +34,27 @@ func parseMetadata(output []byte) (string, string, string, string) {
 
 type configUpdater func(name string, vars map[string]*string) error
 
-func getResource(name, url, iss, sub string, updater configUpdater) *Resource {
+func getResource(name, url, iss, sub string, tool *LLMToolData, updater configUpdater) *Resource {
 	log.Infof("Adding resource %s at %s", name, url)
-	callback := func(pipe *Pipe) error {
-		return updateConfig(name, pipe, updater)
-	}
 	uri := URIData{
 		URI: url,
 	}
-	return &Resource{
+	r := &Resource{
 		ID:             name,
 		DefaultData:    uri,
-		UpdateCallback: &callback,
 		Pipes:          map[string]*Pipe{},
 		Offers: []*Blueprint{
 			// register an https+oidc offer to be a backing_service for another app
 			NewOffer(
 				"backing_service",
 				[]AdapterType{OIDCAuth},
-				[]*PipeTemplate{
+				append([]*PipeTemplate{
 					NewTemplate(
 						true,
 						OIDCAuth,
 						nil,
 					),
-				},
+				}, customAdapterTemplates(true)...),
 				[]*PipeTemplate{
 					NewTemplate(
 						true,
@@ -75,7 +71,7 @@ func getResource(name, url, iss, sub string, updater configUpdater) *Resource {
 			NewNeed(
 				"backing_service",
 				[]AdapterType{OIDCAuth},
-				[]*PipeTemplate{
+				append([]*PipeTemplate{
 					NewTemplate(
 						false,
 						OIDCAuth,
@@ -85,6 +81,34 @@ func getResource(name, url, iss, sub string, updater configUpdater) *Resource {
 							Audience: "backing_service", // audience matches the need
 						},
 					),
+				}, customAdapterTemplates(false)...),
+				[]*PipeTemplate{
+					NewTemplate(
+						false,
+						ProtoHttps,
+						nil,
+					),
+				},
+			),
+			// register an https+oidc need for any number of llm tools
+			NewBlueprint(
+				"tool",
+				[]AdapterType{OIDCAuth, LLMToolMeta},
+				[]*PipeTemplate{
+					NewTemplate(
+						false,
+						OIDCAuth,
+						OIDCAuthData{
+							Issuer:   iss,
+							Subject:  sub,
+							Audience: "tool",
+						},
+					),
+					NewTemplate(
+						false,
+						LLMToolMeta,
+						nil,
+					),
 				},
 				[]*PipeTemplate{
 					NewTemplate(
@@ -93,9 +117,43 @@ func getResource(name, url, iss, sub string, updater configUpdater) *Resource {
 						nil,
 					),
 				},
+				0,
 			),
 		},
 	}
+	if tool != nil {
+		// register an https+oidc offer to be a tool for an agent
+		r.Offers = append(r.Offers, NewOffer(
+			"tool",
+			[]AdapterType{OIDCAuth, LLMToolMeta},
+			[]*PipeTemplate{
+				NewTemplate(
+					true,
+					OIDCAuth,
+					nil,
+				),
+				NewTemplate(
+					true,
+					LLMToolMeta,
+					*tool,
+				),
+			},
+			[]*PipeTemplate{
+				NewTemplate(
+					true,
+					ProtoHttps,
+					URIHttpsData{
+						URI: url,
+					},
+				),
+			},
+		))
+	}
+	callback := func(pipe *Pipe) error {
+		return updateConfig(name, pipe, r.Pipes, &r.noToolsManifest, updater)
+	}
+	r.UpdateCallback = &callback
+	return r
 }
 
 
@@ -111,6 +169,15 @@ func toConfig(data json.RawMessage, prefix string, config map[string]*string) er
 
 	for key, value := range rawMap {
 		strValue := fmt.Sprintf("%v", value)
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			// nested values are passed through as json
+			nested, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("error marshaling JSON: %w", err)
+			}
+			strValue = string(nested)
+		}
 		config[strings.ToUpper(fmt.Sprintf("%s%s", prefix, key))] = &strValue
 	}
 	return nil
@@ -159,7 +226,7 @@ func toIncomingIdentity(pipe *Pipe, config map[string]*string) error {
 		incomingStr := string(incomingJson)
 		config["INCOMING_IDENTITY"] = &incomingStr
 	}
-	if _, ok := rawMap["URI"]; ok {
+	if _, ok := rawMap["URI"]; ok && !isJSONEmpty(pipe.This.Data) {
 		thisMap := map[string]interface{}{}
 		err := json.Unmarshal(pipe.This.Data, &thisMap)
 		if err != nil {
@@ -173,19 +240,72 @@ func toIncomingIdentity(pipe *Pipe, config map[string]*string) error {
 	return nil
 }
 
-func updateConfig(name string, pipe *Pipe, updater configUpdater) error {
+// updateConfig writes the config derived from a pipe along with the tools
+// manifest of all of the pipes. A pipe that is no longer in pipes was deleted,
+// so its config is removed. noManifest tracks whether the manifest is already
+// unset so it is only removed once.
+func updateConfig(name string, pipe *Pipe, pipes map[string]*Pipe, noManifest *bool, updater configUpdater) error {
+	vars, err := pipeVars(pipe)
+	if err != nil {
+		return err
+	}
+	if _, ok := pipes[pipe.ID]; !ok {
+		for k := range vars {
+			vars[k] = nil
+		}
+	}
+	if !isJSONEmpty(pipe.staleOther) {
+		// remove config derived from data the other end no longer provides
+		stale := *pipe
+		stale.Other.Data = pipe.staleOther
+		old, err := pipeVars(&stale)
+		if err != nil {
+			return err
+		}
+		for k := range old {
+			if _, ok := vars[k]; !ok {
+				vars[k] = nil
+			}
+		}
+	}
+	if err := toToolsManifest(pipes, *noManifest, vars); err != nil {
+		return err
+	}
+
+	log.Infof("Updating config for %s with %+v", name, vars)
+	if err := updater(name, vars); err != nil {
+		return err
+	}
+	if manifest, ok := vars[toolsManifestVar]; ok {
+		*noManifest = manifest == nil
+	}
+	return nil
+}
+
+// pipeVars returns the config derived from a single pipe
+func pipeVars(pipe *Pipe) (map[string]*string, error) {
 	vars := map[string]*string{}
 	if err := toConfig(pipe.This.Data, fmt.Sprintf("PIPE_%s_THIS_", pipe.ID), vars); err != nil {
-		return err
+		return nil, err
 	}
 	if err := toConfig(pipe.Other.Data, fmt.Sprintf("PIPE_%s_OTHER_", pipe.ID), vars); err != nil {
-		return err
+		return nil, err
+	}
+	if err := toURIComponents(pipe.This.Data, pipe.This.protos, fmt.Sprintf("PIPE_%s_THIS_", pipe.ID), vars); err != nil {
+		return nil, err
+	}
+	if err := toURIComponents(pipe.Other.Data, pipe.Other.protos, fmt.Sprintf("PIPE_%s_OTHER_", pipe.ID), vars); err != nil {
+		return nil, err
 	}
 	// TODO support multiple connections by aggregating all of the pipes
 	if err := toIncomingIdentity(pipe, vars); err != nil {
-		return err
+		return nil, err
 	}
-
-	log.Infof("Updating config for %s with %+v", name, vars)
-	return updater(name, vars)
+	if err := toWireguardConfig(pipe, vars); err != nil {
+		return nil, err
+	}
+	if err := toLLMTool(pipe, vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
 }
\ No newline at end of file
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// the other end is not known or hasn't been heard from
+	statePending = "pending"
+	// data is being exchanged but hasn't made it both ways yet
+	stateLinked = "linked"
+	// our data was delivered, data from the other end was received and
+	// applied to the config
+	stateInSync = "in-sync"
+	// delivery or applying the config failed, or the other end is gone
+	stateDegraded = "degraded"
+)
+
+// PipeStatus tracks the delivery of data between the ends of a pipe. It is
+// shared by copies of the pipe, so it has its own lock.
+type PipeStatus struct {
+	mutex           sync.Mutex
+	lastSyncAttempt *time.Time
+	lastSyncSuccess *time.Time
+	lastError       string
+	retryCount      int
+	lastInbound     *time.Time
+	lastInboundPeer string
+	lastApply       *time.Time
+	lastApplyError  string
+	// the state in the last status event
+	published string
+	// called after the status changes
+	notify func()
+}
+
+func newPipeStatus(resource *Resource, pid string) *PipeStatus {
+	return &PipeStatus{
+		notify: func() {
+			// the resource may be locked by the caller
+			go publishStatus(resource, pid)
+		},
+	}
+}
+
+func (s *PipeStatus) changed() {
+	if s.notify != nil {
+		s.notify()
+	}
+}
+
+// statePublished records state as published, returning false if it already
+// was
+func (s *PipeStatus) statePublished(state string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.published == state {
+		return false
+	}
+	s.published = state
+	return true
+}
+
+// StatusReport is the json form of the status of a pipe
+type StatusReport struct {
+	State           string     `json:"state"`
+	LastSyncAttempt *time.Time `json:"lastSyncAttempt,omitempty"`
+	LastSyncSuccess *time.Time `json:"lastSyncSuccess,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+	RetryCount      int        `json:"retryCount"`
+	LastInbound     *time.Time `json:"lastInbound,omitempty"`
+	LastInboundPeer string     `json:"lastInboundPeer,omitempty"`
+	LastApply       *time.Time `json:"lastApply,omitempty"`
+	LastApplyError  string     `json:"lastApplyError,omitempty"`
+}
+
+func timestamp() *time.Time {
+	t := time.Now().UTC()
+	return &t
+}
+
+// attempt records that an update is being sent to the other end
+func (s *PipeStatus) attempt() {
+	if s == nil {
+		return
+	}
+	defer s.changed()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastSyncAttempt = timestamp()
+}
+
+// sent records the result of sending an update to the other end
+func (s *PipeStatus) sent(err error, attempts int) {
+	if s == nil {
+		return
+	}
+	defer s.changed()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.lastError = err.Error()
+		s.retryCount = attempts
+		return
+	}
+	s.lastSyncSuccess = timestamp()
+	s.lastError = ""
+	s.retryCount = 0
+}
+
+// received records an update from the other end
+func (s *PipeStatus) received(peer string) {
+	if s == nil {
+		return
+	}
+	defer s.changed()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastInbound = timestamp()
+	s.lastInboundPeer = peer
+}
+
+// applied records the result of writing the pipe to the config of the
+// resource
+func (s *PipeStatus) applied(err error) {
+	if s == nil {
+		return
+	}
+	defer s.changed()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastApply = timestamp()
+	s.lastApplyError = ""
+	if err != nil {
+		s.lastApplyError = err.Error()
+	}
+}
+
+func (s *PipeStatus) report(p *Pipe) *StatusReport {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := &StatusReport{
+		LastSyncAttempt: s.lastSyncAttempt,
+		LastSyncSuccess: s.lastSyncSuccess,
+		LastError:       s.lastError,
+		RetryCount:      s.retryCount,
+		LastInbound:     s.lastInbound,
+		LastInboundPeer: s.lastInboundPeer,
+		LastApply:       s.lastApply,
+		LastApplyError:  s.lastApplyError,
+	}
+	switch {
+	case p.PeerState != "" || s.lastError != "" || s.lastApplyError != "":
+		r.State = stateDegraded
+	case p.Other.URI == "" || (s.lastSyncAttempt == nil && s.lastInbound == nil):
+		r.State = statePending
+	case s.lastSyncSuccess != nil && s.lastInbound != nil:
+		r.State = stateInSync
+	default:
+		r.State = stateLinked
+	}
+	return r
+}
+
+// MarshalJSON adds the status to the pipe. The status is never read from
+// requests.
+func (p Pipe) MarshalJSON() ([]byte, error) {
+	type pipe Pipe
+	return json.Marshal(struct {
+		pipe
+		Status *StatusReport `json:"status,omitempty"`
+	}{pipe(p), p.Status.report(&p)})
+}
+
+// MarshalJSON adds the status to the binding in the same way as for a pipe.
+// The MarshalJSON of the embedded pipe is hidden, since once promoted it
+// would leave out the fields of the binding.
+func (b Binding) MarshalJSON() ([]byte, error) {
+	type binding Binding
+	return json.Marshal(struct {
+		binding
+		MarshalJSON struct{}      `json:"-"`
+		Status      *StatusReport `json:"status,omitempty"`
+	}{binding: binding(b), Status: b.Status.report(&b.Pipe)})
+}
@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParsedURI holds the components of a connection URI. Hosts lists every
+// host:port in the URI, Host and Port are taken from the first one.
+type ParsedURI struct {
+	Scheme   string
+	Host     string
+	Port     string
+	Hosts    []string
+	Username string
+	Password string
+	Database string
+	Params   url.Values
+	TLS      bool
+}
+
+// Address returns the first host:port, e.g. for connectivity checks
+func (u *ParsedURI) Address() string {
+	return net.JoinHostPort(u.Host, u.Port)
+}
+
+// uriSpec describes the URIs accepted for a proto
+type uriSpec struct {
+	schemes     []string
+	defaultPort string
+	// schemes that always use tls
+	tlsSchemes []string
+	// query parameters and the values that enable tls
+	tlsParams  map[string][]string
+	requireTLS bool
+	// multiple comma separated hosts are allowed
+	multiHost bool
+	// schemes that resolve the port from dns and must not include one
+	noPortSchemes []string
+	// the path is a database number instead of a name
+	numericDatabase bool
+}
+
+var protoURISpecs = map[ProtoType]*uriSpec{
+	ProtoHttps: {
+		schemes:     []string{"https"},
+		defaultPort: "443",
+		tlsSchemes:  []string{"https"},
+		requireTLS:  true,
+	},
+	ProtoRediss: {
+		schemes:         []string{"rediss"},
+		defaultPort:     "6379",
+		tlsSchemes:      []string{"rediss"},
+		requireTLS:      true,
+		numericDatabase: true,
+	},
+	ProtoPostgresqls: {
+		schemes:     []string{"postgresqls", "postgresql", "postgres"},
+		defaultPort: "5432",
+		tlsSchemes:  []string{"postgresqls"},
+		tlsParams: map[string][]string{
+			"sslmode": {"require", "verify-ca", "verify-full"},
+		},
+		requireTLS: true,
+		multiHost:  true,
+	},
+	ProtoMysql: {
+		schemes:     []string{"mysql"},
+		defaultPort: "3306",
+		tlsParams: map[string][]string{
+			"ssl-mode": {"REQUIRED", "VERIFY_CA", "VERIFY_IDENTITY"},
+			"tls":      {"true", "skip-verify", "preferred"},
+		},
+	},
+	ProtoMongodb: {
+		schemes:     []string{"mongodb", "mongodb+srv"},
+		defaultPort: "27017",
+		tlsSchemes:  []string{"mongodb+srv"},
+		tlsParams: map[string][]string{
+			"tls": {"true"},
+			"ssl": {"true"},
+		},
+		multiHost:     true,
+		noPortSchemes: []string{"mongodb+srv"},
+	},
+	ProtoAmqps: {
+		schemes:     []string{"amqps"},
+		defaultPort: "5671",
+		tlsSchemes:  []string{"amqps"},
+		requireTLS:  true,
+	},
+	ProtoNats: {
+		schemes:     []string{"nats", "tls"},
+		defaultPort: "4222",
+		tlsSchemes:  []string{"tls"},
+		multiHost:   true,
+	},
+	ProtoSmtp: {
+		schemes:     []string{"smtp", "smtps"},
+		defaultPort: "587",
+		tlsSchemes:  []string{"smtps"},
+	},
+	ProtoGrpc: {
+		schemes:     []string{"grpc", "grpcs"},
+		defaultPort: "443",
+		tlsSchemes:  []string{"grpcs"},
+	},
+}
+
+// ParseURI parses and validates a connection URI for proto
+func ParseURI(proto ProtoType, uri string) (*ParsedURI, error) {
+	spec, ok := protoURISpecs[proto]
+	if !ok {
+		return nil, fmt.Errorf("proto '%s' does not use a URI", proto)
+	}
+	return spec.parse(uri)
+}
+
+func (s *uriSpec) parse(uri string) (*ParsedURI, error) {
+	// hosts are split manually since url.Parse only accepts a single host
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("URI '%s' is missing a scheme", uri)
+	}
+	scheme = strings.ToLower(scheme)
+	if !slices.Contains(s.schemes, scheme) {
+		return nil, fmt.Errorf("URI scheme '%s' must be one of %v", scheme, s.schemes)
+	}
+	authority, _, _ := strings.Cut(rest, "/")
+	authority, _, _ = strings.Cut(authority, "?")
+	// passwords may contain an unescaped @, so split at the last one
+	userinfo, hostlist, found := "", authority, false
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, hostlist, found = authority[:i], authority[i+1:], true
+	}
+	placeholder := fmt.Sprintf("%s://placeholder%s", scheme, rest[len(authority):])
+	if found {
+		placeholder = fmt.Sprintf("%s://%s@placeholder%s", scheme, userinfo, rest[len(authority):])
+	}
+	u, err := url.Parse(placeholder)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URI: %w", err)
+	}
+
+	parsed := &ParsedURI{
+		Scheme: scheme,
+		Params: u.Query(),
+		Hosts:  []string{},
+	}
+	if u.User != nil {
+		parsed.Username = u.User.Username()
+		parsed.Password, _ = u.User.Password()
+	}
+
+	if hostlist == "" {
+		return nil, fmt.Errorf("URI is missing a host")
+	}
+	hosts := strings.Split(hostlist, ",")
+	if len(hosts) > 1 && !s.multiHost {
+		return nil, fmt.Errorf("URI scheme '%s' only allows a single host", scheme)
+	}
+	for _, h := range hosts {
+		host, port, err := splitHostPort(h)
+		if err != nil {
+			return nil, err
+		}
+		if port != "" && slices.Contains(s.noPortSchemes, scheme) {
+			return nil, fmt.Errorf("URI scheme '%s' does not allow a port", scheme)
+		}
+		if port == "" {
+			port = s.defaultPort
+		}
+		if parsed.Host == "" {
+			parsed.Host = host
+			parsed.Port = port
+		}
+		parsed.Hosts = append(parsed.Hosts, net.JoinHostPort(host, port))
+	}
+
+	parsed.Database = strings.TrimPrefix(u.Path, "/")
+	if s.numericDatabase && parsed.Database != "" {
+		if _, err := strconv.Atoi(parsed.Database); err != nil {
+			return nil, fmt.Errorf("URI database '%s' must be a number", parsed.Database)
+		}
+	}
+
+	parsed.TLS = slices.Contains(s.tlsSchemes, scheme)
+	for param, values := range s.tlsParams {
+		if v := parsed.Params.Get(param); v != "" && slices.Contains(values, v) {
+			parsed.TLS = true
+		}
+	}
+	if s.requireTLS && !parsed.TLS {
+		if len(s.tlsParams) == 0 {
+			return nil, fmt.Errorf("URI must use tls")
+		}
+		options := []string{}
+		for param, values := range s.tlsParams {
+			options = append(options, fmt.Sprintf("%s=%s", param, strings.Join(values, "|")))
+		}
+		slices.Sort(options)
+		return nil, fmt.Errorf("URI must use tls, use scheme %v or set %s", s.tlsSchemes, strings.Join(options, " or "))
+	}
+	return parsed, nil
+}
+
+func splitHostPort(hostport string) (string, string, error) {
+	if hostport == "" {
+		return "", "", fmt.Errorf("URI has an empty host")
+	}
+	host, port := hostport, ""
+	if strings.Contains(hostport, ":") && !strings.HasSuffix(hostport, "]") {
+		var err error
+		host, port, err = net.SplitHostPort(hostport)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid URI host '%s': %w", hostport, err)
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return "", "", fmt.Errorf("invalid URI port '%s'", port)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return "", "", fmt.Errorf("URI has an empty host")
+	}
+	return host, port, nil
+}
+
+// validateProtoData checks the structure of the data for a proto beyond what
+// is expressed in the json schema
+func validateProtoData(proto ProtoType, data json.RawMessage) error {
+	switch proto {
+	case ProtoKafka:
+		var kafka KafkaData
+		if err := json.Unmarshal(data, &kafka); err != nil {
+			return err
+		}
+		if kafka.BootstrapServers == "" {
+			return nil
+		}
+		for _, server := range strings.Split(kafka.BootstrapServers, ",") {
+			_, port, err := splitHostPort(strings.TrimSpace(server))
+			if err != nil {
+				return fmt.Errorf("BOOTSTRAP_SERVERS: %w", err)
+			}
+			if port == "" {
+				return fmt.Errorf("BOOTSTRAP_SERVERS: '%s' is missing a port", server)
+			}
+		}
+		return nil
+	case ProtoS3:
+		var s3 S3Data
+		if err := json.Unmarshal(data, &s3); err != nil {
+			return err
+		}
+		if s3.Endpoint == "" {
+			return nil
+		}
+		if _, err := ParseURI(ProtoHttps, s3.Endpoint); err != nil {
+			return fmt.Errorf("ENDPOINT: %w", err)
+		}
+		return nil
+	}
+	if _, ok := protoURISpecs[proto]; !ok {
+		return nil
+	}
+	var uri URIData
+	if err := json.Unmarshal(data, &uri); err != nil {
+		return err
+	}
+	if uri.URI == "" {
+		// the URI is provided by the other end
+		return nil
+	}
+	if _, err := ParseURI(proto, uri.URI); err != nil {
+		return fmt.Errorf("URI: %w", err)
+	}
+	return nil
+}
+
+// toURIComponents adds config vars for the parts of the URI in data
+func toURIComponents(data json.RawMessage, protos []ProtoType, prefix string, config map[string]*string) error {
+	if isJSONEmpty(data) {
+		return nil
+	}
+	var uri URIData
+	if err := json.Unmarshal(data, &uri); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if uri.URI == "" {
+		return nil
+	}
+	for _, proto := range protos {
+		if _, ok := protoURISpecs[proto]; !ok {
+			continue
+		}
+		parsed, err := ParseURI(proto, uri.URI)
+		if err != nil {
+			return err
+		}
+		components := map[string]string{
+			"HOST":     parsed.Host,
+			"PORT":     parsed.Port,
+			"USERNAME": parsed.Username,
+			"PASSWORD": parsed.Password,
+			"DATABASE": parsed.Database,
+		}
+		for key, value := range components {
+			if value == "" {
+				continue
+			}
+			v := value
+			config[strings.ToUpper(fmt.Sprintf("%sURI_%s", prefix, key))] = &v
+		}
+	}
+	return nil
+}
@@ -7,24 +7,41 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"math"
+	"maps"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
-	"time"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/invopop/jsonschema"
 )
 
 // Configuration struct
 type ServerConfig struct {
 	Prefix string
+	Auth   BrokerAuth
 }
 
 type contextKey string
 
-const configKey contextKey = "config"
+const (
+	configKey contextKey = "config"
+	peerKey   contextKey = "peer"
+)
+
+// fromPeer returns true if the request was authenticated with a token from
+// the other end of the pipe
+func fromPeer(r *http.Request) bool {
+	return peerToken(r) != nil
+}
+
+// peerToken returns the token the other end of the pipe authenticated with
+func peerToken(r *http.Request) *oidc.IDToken {
+	token, _ := r.Context().Value(peerKey).(*oidc.IDToken)
+	return token
+}
 
 // Middleware to add configuration to the context
 func configMiddleware(config ServerConfig, next http.Handler) http.Handler {
@@ -45,15 +62,44 @@ func getPortAndPrefix(port string) (string, string) {
 	return port, prefix
 }
 
-func runBrokerServer(port string, resources map[string]*Resource) error {
+func runBrokerServer(port string, auth BrokerAuth, registry *Registry) error {
 	api := http.NewServeMux()
-	registerPipeRoutes(api, resources)
+	registerPipeRoutes(api, registry)
 	registerOIDCRoutes(api)
-	config := ServerConfig{}
+	// admin routes are kept separate since they would conflict with the
+	// per resource routes in a single mux
+	admin := http.NewServeMux()
+	registerAdminRoutes(admin, registry)
+	root := http.NewServeMux()
+	root.Handle("/resources", admin)
+	root.Handle("/resources/", admin)
+	root.Handle("/compatibility", admin)
+	root.Handle("/outbox", admin)
+	root.Handle("/outbox/", admin)
+	root.Handle("/relay/", admin)
+	root.Handle("/", api)
+	config := ServerConfig{Auth: auth}
 	port, config.Prefix = getPortAndPrefix(port)
+	if relayURL != "" {
+		var err error
+		if config.Prefix, err = relayPrefix(relayURL); err != nil {
+			return err
+		}
+	}
+	handler := configMiddleware(config, root)
+	if err := outbox.Start(stateDir, outboxMaxAttempts, outboxWorkers, updateDebounce, peerRate); err != nil {
+		return err
+	}
+	startReconciler(registry, &config, reconcileInterval, reconcileConcurrency)
+	startPuller(registry, &config, pullInterval, pullWait)
+
+	if relayURL != "" {
+		log.Infof("Receiving requests for %s through the relay", config.Prefix)
+		go connectRelay(relayURL, handler)
+	}
 
 	log.Infof("Listening on :%s...", port)
-	return http.ListenAndServe(fmt.Sprintf(":%s", port), configMiddleware(config, api))
+	return http.ListenAndServe(fmt.Sprintf(":%s", port), handler)
 }
 
 func debug(w http.ResponseWriter, req *http.Request) {
@@ -88,10 +134,19 @@ func debug(w http.ResponseWriter, req *http.Request) {
 
 type resourceHandler func(*Resource, http.ResponseWriter, *http.Request)
 
-func unwrapResource(resources map[string]*Resource, rh resourceHandler) http.HandlerFunc {
+// readLocked holds the read lock on the resource while rh runs
+func readLocked(rh resourceHandler) resourceHandler {
+	return func(resource *Resource, w http.ResponseWriter, r *http.Request) {
+		resource.Mutex.RLock()
+		defer resource.Mutex.RUnlock()
+		rh(resource, w, r)
+	}
+}
+
+func unwrapResource(registry *Registry, rh resourceHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
-		if resource, ok := resources[id]; ok {
+		if resource, ok := registry.Get(id); ok {
 			rh(resource, w, r)
 			return
 		}
@@ -129,8 +184,8 @@ func basicAuth(next http.Handler) http.Handler {
 
 		username, password := credentials[0], credentials[1]
 
-		// hack to demonstrate we can have some kind of auth
-		if username != "foo" || password != "bar" {
+		expected := r.Context().Value(configKey).(ServerConfig).Auth
+		if username != expected.User || password != expected.Pass {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -140,49 +195,61 @@ func basicAuth(next http.Handler) http.Handler {
 	})
 }
 
-func validateAgainstPipe(ctx context.Context, token string, pipe *Pipe) error {
+func validateAgainstPipe(ctx context.Context, token string, pipe *Pipe) (*oidc.IDToken, error) {
 	var val Validator
 	var err error
 	val.Iss, err = regexp.Compile(pipe.Other.Issuer)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	val.Aud, err = regexp.Compile(pipe.This.URI)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	val.Sub, err = regexp.Compile(pipe.Other.URI)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := Validate(ctx, token, val); err != nil {
-		return fmt.Errorf("failed to Validate token: %w", err)
+	verified, err := Validate(ctx, token, val)
+	if err != nil {
+		return nil, fmt.Errorf("failed to Validate token: %w", err)
 	}
-	return nil
+	return verified, nil
 }
 
-func oidcAuth(resources map[string]*Resource, next http.Handler) http.HandlerFunc {
+func oidcAuth(registry *Registry, next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get("Authorization")
 		if auth != "" && strings.HasPrefix(auth, "Bearer ") {
 			// Try Bearer Auth
 			token := strings.TrimPrefix(auth, "Bearer ")
 			id := r.PathValue("id")
-			if resource, ok := resources[id]; ok {
-				resource.Mutex.RLock()
-				pid := r.PathValue("pid")
-				if pipe, ok := resource.Pipes[pid]; ok {
-					if err := validateAgainstPipe(r.Context(), token, pipe); err != nil {
-						log.Errorf("Invalid token: %s", err)
-						http.Error(w, "Unauthorized", http.StatusUnauthorized)
-						return
-					}
-					resource.Mutex.RUnlock()
-					next.ServeHTTP(w, r)
-					return
-				}
+			pid := r.PathValue("pid")
+			resource, ok := registry.Get(id)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Resource '%s' not found", id), http.StatusNotFound)
+				return
+			}
+			resource.Mutex.RLock()
+			pipe, ok := resource.Pipes[pid]
+			if !ok {
+				// the other end may already have been deleted
 				resource.Mutex.RUnlock()
+				http.Error(w, fmt.Sprintf("Pipe '%s' not found", pid), http.StatusNotFound)
+				return
 			}
+			verified, err := validateAgainstPipe(r.Context(), token, pipe)
+			if err != nil {
+				resource.Mutex.RUnlock()
+				log.Errorf("Invalid token: %s", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			resource.Mutex.RUnlock()
+			// mark the request as coming from the other end of the pipe
+			ctx := context.WithValue(r.Context(), peerKey, verified)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
 		}
 
 		// failed this auth so try basic
@@ -190,105 +257,102 @@ func oidcAuth(resources map[string]*Resource, next http.Handler) http.HandlerFun
 	})
 }
 
-func registerPipeRoutes(api *http.ServeMux, resources map[string]*Resource) {
+func registerPipeRoutes(api *http.ServeMux, registry *Registry) {
 	api.Handle("/debug", http.HandlerFunc(debug))
-	api.Handle("/{id}/pipes", basicAuth(unwrapResource(resources, pipesHandler)))
-	api.Handle("/{id}/pipes/{pid}", oidcAuth(resources, unwrapResource(resources, pipeHandler)))
-	api.Handle("/{id}/needs", basicAuth(unwrapResource(resources, readNeeds)))
-	api.Handle("/{id}/offers", basicAuth(unwrapResource(resources, readOffers)))
-	api.Handle("/{id}/needs/{sid}", basicAuth(unwrapResource(resources, readNeed)))
-	api.Handle("/{id}/offers/{sid}", basicAuth(unwrapResource(resources, readOffer)))
-	api.Handle("/{id}/needs/{sid}/adapters", basicAuth(unwrapResource(resources, readNeedAdapters)))
-	api.Handle("/{id}/offers/{sid}/adapters", basicAuth(unwrapResource(resources, readOfferAdapters)))
-	api.Handle("/{id}/needs/{sid}/protos", basicAuth(unwrapResource(resources, readNeedProtos)))
-	api.Handle("/{id}/offers/{sid}/protos", basicAuth(unwrapResource(resources, readOfferProtos)))
-	api.Handle("/{id}/needs/{sid}/adapters/{tid}", basicAuth(unwrapResource(resources, readNeedAdapter)))
-	api.Handle("/{id}/offers/{sid}/adapters/{tid}", basicAuth(unwrapResource(resources, readOfferAdapter)))
-	api.Handle("/{id}/needs/{sid}/protos/{tid}", basicAuth(unwrapResource(resources, readNeedProto)))
-	api.Handle("/{id}/offers/{sid}/protos/{tid}", basicAuth(unwrapResource(resources, readOfferProto)))
-	api.Handle("/{id}/needs/{sid}/bindings", basicAuth(unwrapResource(resources, needsBindingsHandler)))
-	api.Handle("/{id}/offers/{sid}/bindings", basicAuth(unwrapResource(resources, offersBindingsHandler)))
+	api.Handle("/{id}/pipes", basicAuth(unwrapResource(registry, pipesHandler)))
+	api.Handle("/{id}/pipes/{pid}", oidcAuth(registry, unwrapResource(registry, pipeHandler)))
+	api.Handle("/{id}/pipes/events", basicAuth(unwrapResource(registry, pipesEventsHandler)))
+	api.Handle("/{id}/pipes/{pid}/events", basicAuth(unwrapResource(registry, pipeEventsHandler)))
+	api.Handle("/{id}/pipes/{pid}/peer", oidcAuth(registry, unwrapResource(registry, readLocked(peerHandler))))
+	api.Handle("/{id}/pipes/{pid}/rotate", basicAuth(unwrapResource(registry, rotateHandler)))
+	api.Handle("/{id}/needs", basicAuth(unwrapResource(registry, readLocked(readNeeds))))
+	api.Handle("/{id}/offers", basicAuth(unwrapResource(registry, readLocked(readOffers))))
+	api.Handle("/{id}/needs/{sid}", basicAuth(unwrapResource(registry, needHandler)))
+	api.Handle("/{id}/offers/{sid}", basicAuth(unwrapResource(registry, offerHandler)))
+	api.Handle("/{id}/needs/{sid}/adapters", basicAuth(unwrapResource(registry, readLocked(readNeedAdapters))))
+	api.Handle("/{id}/offers/{sid}/adapters", basicAuth(unwrapResource(registry, readLocked(readOfferAdapters))))
+	api.Handle("/{id}/needs/{sid}/protos", basicAuth(unwrapResource(registry, readLocked(readNeedProtos))))
+	api.Handle("/{id}/offers/{sid}/protos", basicAuth(unwrapResource(registry, readLocked(readOfferProtos))))
+	api.Handle("/{id}/needs/{sid}/adapters/{tid}", basicAuth(unwrapResource(registry, needAdapterHandler)))
+	api.Handle("/{id}/offers/{sid}/adapters/{tid}", basicAuth(unwrapResource(registry, offerAdapterHandler)))
+	api.Handle("/{id}/needs/{sid}/protos/{tid}", basicAuth(unwrapResource(registry, needProtoHandler)))
+	api.Handle("/{id}/offers/{sid}/protos/{tid}", basicAuth(unwrapResource(registry, offerProtoHandler)))
+	api.Handle("/{id}/needs/{sid}/bindings", basicAuth(unwrapResource(registry, needsBindingsHandler)))
+	api.Handle("/{id}/offers/{sid}/bindings", basicAuth(unwrapResource(registry, offersBindingsHandler)))
+	api.Handle("/{id}/offers/{sid}/invitations", basicAuth(unwrapResource(registry, invitationsHandler)))
+	api.Handle("/{id}/offers/{sid}/invitations/redeem", unwrapResource(registry, redeemHandler))
+	api.Handle("/{id}/needs/{sid}/invitations", basicAuth(unwrapResource(registry, acceptHandler)))
 	// TODO: make a redirect at bindings/{name}
 }
 
 func needsBindingsHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	bindingsHandler(resource, resource.Needs, w, r)
+	bindingsHandler(resource, false, w, r)
 }
 
 func offersBindingsHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	bindingsHandler(resource, resource.Offers, w, r)
+	bindingsHandler(resource, true, w, r)
 }
 
-func bindingsHandler(resource *Resource, blueprints []*Blueprint, w http.ResponseWriter, r *http.Request) {
+func bindingsHandler(resource *Resource, provider bool, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	resource.Mutex.Lock()
+	defer resource.Mutex.Unlock()
 	sid := r.PathValue("sid")
-	for _, s := range blueprints {
-		if sid == s.Name {
-			var b Binding
-			if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+	s := resource.findBlueprint(provider, sid)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("Blueprint '%s' not found", sid), http.StatusNotFound)
+		return
+	}
+	if s.Retired {
+		http.Error(w, fmt.Sprintf("Blueprint '%s' is retired", sid), http.StatusGone)
+		return
+	}
+	var b Binding
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc := r.Context().Value(configKey).(ServerConfig)
+	if bindBlueprint(resource, s, &b, strings.TrimSuffix(r.URL.Path, "/bindings"), &sc, w) {
+		writeBinding(resource, &b, w)
+	}
+}
 
-			adapters := s.DefaultAdapters
-			if len(b.Adapters) == 0 {
-				b.Adapters = adapters
-			}
-			missing := []AdapterType{}
-			templates := []*PipeTemplate{}
-		outer:
-			for _, want := range b.Adapters {
-				for _, have := range s.Adapters {
-					if want == have.ID {
-						templates = append(templates, have)
-						break outer
-					}
-				}
-				missing = append(missing, want)
-			}
-			if len(missing) > 0 {
-				http.Error(w, fmt.Sprintf("Adapters '%v' not found", missing), http.StatusNotFound)
-			}
-			proto := s.Protos[0]
-			if b.Proto == "" {
-				b.Proto = proto.ID.(ProtoType)
-			} else {
-				found := false
-				for _, t := range s.Protos {
-					if t.ID == b.Proto {
-						proto = t
-						found = true
-						break
-					}
-				}
-				if !found {
-					http.Error(w, fmt.Sprintf("Proto '%s' not found", b.Proto), http.StatusNotFound)
-				}
-			}
-			templates = append(templates, proto)
-			sc := r.Context().Value(configKey).(ServerConfig)
-			if createPipe(resource, w, &b.Pipe, &sc, s, templates) {
-				path := fmt.Sprintf("%s%s", sc.Prefix, strings.TrimSuffix(r.URL.Path, "/bindings"))
-				b.Pipe.Links.Blueprint = &Link{Href: path}
-				links := []*Link{}
-				for _, item := range b.Adapters {
-					links = append(links, &Link{Href: fmt.Sprintf("%s/adapters/%s", path, item)})
-				}
-				b.Pipe.Links.Adapters = links
-				b.Pipe.Links.Proto = &Link{Href: fmt.Sprintf("%s/protos/%s", path, b.Proto)}
-				location := fmt.Sprintf("/%s/pipes/%s", resource.ID, b.Pipe.ID)
-				w.Header().Set("Location", location)
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusCreated)
-				json.NewEncoder(w).Encode(b)
-			}
-			return
-		}
+// bindBlueprint negotiates the binding with the blueprint at path and creates
+// the pipe. It writes an error response and returns false on failure.
+func bindBlueprint(resource *Resource, s *Blueprint, b *Binding, path string, sc *ServerConfig, w http.ResponseWriter) bool {
+	templates, err := s.Negotiate(b)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, err)
+		return false
 	}
-	http.Error(w, fmt.Sprintf("Blueprint '%s' not found", sid), http.StatusNotFound)
+	if !createPipe(resource, w, &b.Pipe, sc, s, templates) {
+		return false
+	}
+	path = fmt.Sprintf("%s%s", sc.Prefix, path)
+	b.Pipe.Links.Blueprint = &Link{Href: path}
+	links := []*Link{}
+	for _, item := range b.Adapters {
+		links = append(links, &Link{Href: fmt.Sprintf("%s/adapters/%s", path, item)})
+	}
+	b.Pipe.Links.Adapters = links
+	b.Pipe.Links.Proto = &Link{Href: fmt.Sprintf("%s/protos/%s", path, b.Proto)}
+	return true
+}
+
+func writeBinding(resource *Resource, b *Binding, w http.ResponseWriter) {
+	location := fmt.Sprintf("/%s/pipes/%s", resource.ID, b.Pipe.ID)
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusCreated, b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
 func readNeeds(resource *Resource, w http.ResponseWriter, r *http.Request) {
@@ -309,14 +373,6 @@ func readBlueprints(s []*Blueprint, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(s)
 }
 
-func readNeed(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	readBlueprint(resource.Needs, w, r)
-}
-
-func readOffer(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	readBlueprint(resource.Offers, w, r)
-}
-
 func readBlueprint(blueprints []*Blueprint, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -382,22 +438,6 @@ func readProtos(blueprints []*Blueprint, w http.ResponseWriter, r *http.Request)
 	http.Error(w, fmt.Sprintf("Blueprint '%s' not found", sid), http.StatusNotFound)
 }
 
-func readNeedAdapter(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	readAdapter(resource.Needs, w, r)
-}
-
-func readOfferAdapter(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	readAdapter(resource.Offers, w, r)
-}
-
-func readNeedProto(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	readProto(resource.Needs, w, r)
-}
-
-func readOfferProto(resource *Resource, w http.ResponseWriter, r *http.Request) {
-	readProto(resource.Offers, w, r)
-}
-
 func readAdapter(blueprints []*Blueprint, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -485,8 +525,16 @@ func readPipes(resource *Resource, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(resource.Pipes)
 }
 
+// reservedPipeIDs can't be used for pipes since they are routes under
+// /{id}/pipes
+var reservedPipeIDs = []string{"events"}
+
 func createPipe(resource *Resource, w http.ResponseWriter, p *Pipe, sc *ServerConfig, s *Blueprint, ts []*PipeTemplate) bool {
-	if _, ok := resource.Pipes[p.ID]; ok {
+	if slices.Contains(reservedPipeIDs, p.ID) {
+		http.Error(w, fmt.Sprintf("Pipe id '%s' is reserved", p.ID), http.StatusBadRequest)
+		return false
+	}
+	if _, ok := resource.Pipes[p.ID]; ok || resource.pipeBusy(p.ID) {
 		http.Error(w, fmt.Sprintf("Pipe '%s' already exists", p.ID), http.StatusConflict)
 		return false
 	}
@@ -495,6 +543,7 @@ func createPipe(resource *Resource, w http.ResponseWriter, p *Pipe, sc *ServerCo
 	p.This.URI = fmt.Sprintf("%s%s", sc.Prefix, location)
 	p.Links.Self = &Link{Href: p.This.URI}
 	p.This.Issuer = sc.Prefix
+	p.Status = newPipeStatus(resource, p.ID)
 	// Merge in server provided strategy info
 	if s != nil {
 		if !s.AddPipe(p.ID) {
@@ -542,27 +591,46 @@ func createPipe(resource *Resource, w http.ResponseWriter, p *Pipe, sc *ServerCo
 			}
 		}
 	}
-	resource.Pipes[p.ID] = p
-	maybeUpdateOther(p, sc)
-	if resource.UpdateCallback != nil {
-		// TODO: error handling and retries
-		if err := (*resource.UpdateCallback)(p); err != nil {
-			log.Errorf("Error calling update callback: %v", err)
+	// Let adapters generate their per pipe data
+	p.templates = ts
+	for _, t := range ts {
+		if proto, ok := t.ID.(ProtoType); ok {
+			p.This.protos = append(p.This.protos, proto)
+			p.Other.protos = append(p.Other.protos, proto)
 		}
 	}
+	if err := runAdapters(resource, p, func(h AdapterHandler, t *PipeTemplate) error {
+		return h.Bind(p, t)
+	}); err != nil {
+		log.Error(err)
+		if s != nil {
+			s.DeletePipe(p.ID)
+		}
+		http.Error(w, fmt.Sprintf("Could not bind adapter: %s", err), http.StatusInternalServerError)
+		return false
+	}
+	if err := p.Validate(); err != nil {
+		// release anything the adapters created, such as provisioned
+		// credentials
+		unbindPipe(resource, p)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	resource.Pipes[p.ID] = p
+	publishPipe(eventCreated, resource, p)
+	maybeUpdateOther(p, sc)
+	applyConfig(resource, p)
 	return true
 }
 
 func pipeHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
 	pid := r.PathValue("pid")
 	resource.Mutex.RLock()
-	if pipe, ok := resource.Pipes[pid]; ok {
+	if _, ok := resource.Pipes[pid]; ok {
 		resource.Mutex.RUnlock()
 		switch r.Method {
 		case http.MethodGet:
-			resource.Mutex.RLock()
-			defer resource.Mutex.RUnlock()
-			readPipe(pipe, w)
+			readPipeConditional(resource, pid, w, r)
 		case http.MethodPatch:
 			resource.Mutex.Lock()
 			defer resource.Mutex.Unlock()
@@ -570,7 +638,12 @@ func pipeHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
 		case http.MethodDelete:
 			resource.Mutex.Lock()
 			defer resource.Mutex.Unlock()
-			deletePipe(resource.Pipes, pid, w)
+			if fromPeer(r) {
+				disconnectPipe(resource, pid, w, r)
+				return
+			}
+			sc := r.Context().Value(configKey).(ServerConfig)
+			deletePipe(resource, pid, &sc, w)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -586,16 +659,16 @@ func readPipe(p *Pipe, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(p)
 }
 
-const (
-	maxRetries = 5
-	baseDelay  = 1 * time.Second  // initial delay
-	maxDelay   = 32 * time.Second // maximum delay
-)
-
-func updateOther(token string, uri string, data json.RawMessage) {
+// updateOther sends this end of the pipe to the other end at uri. Including
+// our uri and issuer links the other end back to us if it was created with
+// only our issuer, since it checks them against our token.
+func updateOther(issuer string, p *Pipe) {
 	pipe := Pipe{
 		Other: End{
-			Data: data,
+			URI:      p.This.URI,
+			Issuer:   p.This.Issuer,
+			Data:     p.This.Data,
+			Delivery: p.This.Delivery,
 		},
 	}
 	jsonData, err := json.Marshal(pipe)
@@ -603,61 +676,65 @@ func updateOther(token string, uri string, data json.RawMessage) {
 		log.Errorf("Error marshalling json: %v", err)
 		return
 	}
+	outbox.Enqueue(http.MethodPatch, p.Other.URI, issuer, p.This.URI, jsonData, p.Status)
+}
 
-	// Run the update in a separate goroutine
-	go func() {
-		for i := 0; i < maxRetries; i++ {
-			err = doRequest(token, uri, jsonData)
-			if err == nil {
-				return
-			}
-
-			delay := baseDelay * time.Duration(math.Pow(2, float64(i)))
-			if delay > maxDelay {
-				delay = maxDelay
-			}
-			log.Infof("Retrying in %v due to error: %v", delay, err)
-			time.Sleep(delay)
-		}
-		log.Warnf("Failed to send update after %d retries", maxRetries)
-	}()
+// deleteOther tells the other end of a pipe that this end is gone
+func deleteOther(issuer string, uri string, subject string) {
+	outbox.Enqueue(http.MethodDelete, uri, issuer, subject, nil, nil)
 }
 
-func doRequest(token, uri string, jsonData []byte) error {
-	req, err := http.NewRequest(http.MethodPatch, uri, bytes.NewBuffer(jsonData))
+func doRequest(method, token, uri string, jsonData []byte, header http.Header) error {
+	req, err := http.NewRequest(method, uri, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("error creating update request: %v", err)
 	}
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := brokerClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("error sending update request: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusAccepted {
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+	case method == http.MethodDelete && resp.StatusCode == http.StatusNoContent:
+	case method == http.MethodDelete && resp.StatusCode == http.StatusNotFound:
+		// already deleted on the other end
+	default:
 		return fmt.Errorf("invalid response status: %s", resp.Status)
 	}
 	return nil
 }
 
 func maybeUpdateOther(p *Pipe, sc *ServerConfig) {
-	if p.Other.URI != "" && !isJSONEmpty(p.This.Data) {
-		token, err := generateToken(sc.Prefix, p.Other.URI, p.This.URI)
-		if err != nil {
-			log.Errorf("Error generating token: %v", err)
-			return
-		}
-		updateOther(token, p.Other.URI, p.This.Data)
+	if pushesToOther(p) {
+		updateOther(sc.Prefix, p)
 	}
 }
 
+// pushesToOther reports whether this end sends its data to the other end.
+// The other end fetches our data itself if it pulls, without its issuer we
+// could not check who it is when it answers, and if it was deleted there is
+// nothing to send to until it is linked again.
+func pushesToOther(p *Pipe) bool {
+	return p.Other.URI != "" && p.Other.Issuer != "" && p.Other.Delivery != deliveryPull && p.PeerState == ""
+}
+
 func updatePipe(resource *Resource, pid string, w http.ResponseWriter, r *http.Request) {
-	// local copy of existing pipe
-	p := *resource.Pipes[pid]
+	if resource.pipeBusy(pid) {
+		http.Error(w, fmt.Sprintf("Pipe '%s' is busy", pid), http.StatusConflict)
+		return
+	}
+	// local copy of existing pipe, including its secrets
+	existing := resource.Pipes[pid]
+	p := *existing
+	p.secrets = maps.Clone(existing.secrets)
 	this := p.This
 	other := p.Other
 	var input Pipe
@@ -665,37 +742,267 @@ func updatePipe(resource *Resource, pid string, w http.ResponseWriter, r *http.R
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := p.Merge(&input); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if fromPeer(r) {
+		if err := checkPeerInput(&input, peerToken(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		apply, reason, err := checkSequence(&p, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !apply {
+			// accept it so the other end stops sending it
+			log.Infof("Ignoring %s update for pipe %s/%s", reason, resource.ID, pid)
+			w.Header().Set(ignoredHeader, reason)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
 	}
-	if err := p.Validate(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	reconnected, status, err := mergeUpdate(resource, &p, &input, fromPeer(r))
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
-	resource.Pipes[pid] = &p
-	if !p.This.Equals(this) {
-		sc := r.Context().Value(configKey).(ServerConfig)
+	if reconnected {
+		log.Infof("Other end of pipe %s/%s reconnected", resource.ID, pid)
+	}
+	sc := r.Context().Value(configKey).(ServerConfig)
+	applyPipe(resource, &p, this, other, &sc)
+	if reconnected {
+		// the other end may have been recreated without our data
 		maybeUpdateOther(&p, &sc)
 	}
-	if resource.UpdateCallback != nil && (!p.This.Equals(this) || !p.Other.Equals(other)) {
-		// TODO: error handling and retries
-		if err := (*resource.UpdateCallback)(&p); err != nil {
-			log.Errorf("Error calling update callback: %v", err)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// mergeUpdate merges an update into p, a copy of the pipe, updates its
+// adapters and validates the result. For an update from the other end it
+// records that the other end was heard from and returns true if it had been
+// disconnected. On failure it returns the status to respond with.
+func mergeUpdate(resource *Resource, p *Pipe, input *Pipe, peer bool) (bool, int, error) {
+	this := p.This
+	other := p.Other
+	if err := p.Merge(input); err != nil {
+		return false, http.StatusBadRequest, err
+	}
+	if !p.This.Equals(this) || !p.Other.Equals(other) {
+		if err := runAdapters(resource, p, func(h AdapterHandler, t *PipeTemplate) error {
+			return h.Update(p, t)
+		}); err != nil {
+			log.Error(err)
+			return false, http.StatusInternalServerError, fmt.Errorf("Could not update adapter: %w", err)
+		}
+		if _, ok := resource.Pipes[p.ID]; !ok {
+			return false, http.StatusNotFound, fmt.Errorf("Pipe '%s' not found", p.ID)
 		}
 	}
+	if err := p.Validate(); err != nil {
+		return false, http.StatusBadRequest, err
+	}
+	if !peer {
+		return false, 0, nil
+	}
+	p.Status.received(p.Other.Issuer)
+	// an update from the other end means it is back
+	reconnected := p.PeerState != ""
+	p.PeerState = ""
+	return reconnected, 0, nil
+}
+
+// checkPeerInput makes sure the other end only updates its own end, and only
+// sets its location to the subject and issuer of the token it sent
+func checkPeerInput(input *Pipe, token *oidc.IDToken) error {
+	if !input.This.Equals(End{}) {
+		return fmt.Errorf("this can only be updated by this end")
+	}
+	o := &input.Other
+	if o.URI != "" && o.URI != token.Subject {
+		return fmt.Errorf("other.uri must be the subject of the token")
+	}
+	if o.Issuer != "" && o.Issuer != token.Issuer {
+		return fmt.Errorf("other.issuer must be the issuer of the token")
+	}
+	return nil
+}
+
+// applyPipe stores an updated pipe and propagates any changes to the other
+// end and to the resource. this and other are the ends before the update.
+func applyPipe(resource *Resource, p *Pipe, this End, other End, sc *ServerConfig) {
+	resource.Pipes[p.ID] = p
+	if !p.This.Equals(this) || p.Other.URI != other.URI {
+		// send our data if it changed or the other end just became known
+		maybeUpdateOther(p, sc)
+	}
+	if !p.This.Equals(this) || !p.Other.Equals(other) {
+		publishPipe(eventUpdated, resource, p)
+		applyConfig(resource, p)
+	}
+}
+
+// applyConfig writes the pipe to the config of the resource
+func applyConfig(resource *Resource, p *Pipe) {
+	if resource.UpdateCallback == nil {
+		return
+	}
+	// TODO: error handling and retries
+	err := (*resource.UpdateCallback)(p)
+	if err != nil {
+		log.Errorf("Error calling update callback: %v", err)
+	}
+	p.Status.applied(err)
+}
 
+func rotateHandler(resource *Resource, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pid := r.PathValue("pid")
+	resource.Mutex.Lock()
+	defer resource.Mutex.Unlock()
+	existing, ok := resource.Pipes[pid]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Pipe '%s' not found", pid), http.StatusNotFound)
+		return
+	}
+	if resource.pipeBusy(pid) {
+		http.Error(w, fmt.Sprintf("Pipe '%s' is busy", pid), http.StatusConflict)
+		return
+	}
+	// local copy of existing pipe, including its secrets
+	p := *existing
+	p.secrets = maps.Clone(existing.secrets)
+	if err := runAdapters(resource, &p, func(h AdapterHandler, t *PipeTemplate) error {
+		return h.Rotate(&p, t)
+	}); err != nil {
+		log.Error(err)
+		http.Error(w, fmt.Sprintf("Could not rotate adapter: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := resource.Pipes[pid]; !ok {
+		// deleted along with its resource while rotating
+		http.Error(w, fmt.Sprintf("Pipe '%s' not found", pid), http.StatusNotFound)
+		return
+	}
+	sc := r.Context().Value(configKey).(ServerConfig)
+	applyPipe(resource, &p, existing.This, existing.Other, &sc)
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(p)
 }
 
-func deletePipe(pipes map[string]*Pipe, pid string, w http.ResponseWriter) {
-	// TODO: notify other end of delete
-	if p, ok := pipes[pid]; ok {
-		if p != nil && p.blueprint != nil {
-			p.blueprint.DeletePipe(p.ID)
+func deletePipe(resource *Resource, pid string, sc *ServerConfig, w http.ResponseWriter) {
+	if resource.pipeBusy(pid) {
+		http.Error(w, fmt.Sprintf("Pipe '%s' is busy", pid), http.StatusConflict)
+		return
+	}
+	p, ok := resource.Pipes[pid]
+	delete(resource.Pipes, pid)
+	if ok && p != nil {
+		if p.Other.URI != "" && p.PeerState == "" {
+			deleteOther(sc.Prefix, p.Other.URI, p.This.URI)
 		}
+		publishPipe(eventDeleted, resource, p)
+		unbindPipe(resource, p)
+		// remove the config of the pipe and its tool from the manifest
+		applyConfig(resource, p)
 	}
-	delete(pipes, pid)
+	resource.pruneBlueprints()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// disconnectPipe handles a delete from the other end of the pipe. This end is
+// kept so it can be linked again, but depending on the peer delete mode the
+// data from the other end is removed from the config of the resource.
+func disconnectPipe(resource *Resource, pid string, w http.ResponseWriter, r *http.Request) {
+	if resource.pipeBusy(pid) {
+		http.Error(w, fmt.Sprintf("Pipe '%s' is busy", pid), http.StatusConflict)
+		return
+	}
+	p := resource.Pipes[pid]
+	apply, reason, err := checkSequence(p, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !apply {
+		log.Infof("Ignoring %s delete for pipe %s/%s", reason, resource.ID, pid)
+		w.Header().Set(ignoredHeader, reason)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	p.Status.received(p.Other.Issuer)
+	if peerDeleteMode == peerOrphaned {
+		log.Infof("Other end of pipe %s/%s was deleted, keeping its data", resource.ID, pid)
+		p.PeerState = peerOrphaned
+		publishPipe(eventUpdated, resource, p)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Infof("Other end of pipe %s/%s was deleted, removing its data", resource.ID, pid)
+	p.PeerState = peerDisconnected
+	p.staleOther = p.Other.Data
+	p.Other.Data = nil
+	publishPipe(eventUpdated, resource, p)
+	applyConfig(resource, p)
+	p.staleOther = nil
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unbindPipe releases everything held by a pipe that was removed from the
+// resource
+func unbindPipe(resource *Resource, p *Pipe) {
+	if p.blueprint != nil {
+		p.blueprint.DeletePipe(p.ID)
+	}
+	runAdapters(resource, p, func(h AdapterHandler, t *PipeTemplate) error {
+		if err := h.Unbind(p, t); err != nil {
+			log.Errorf("Error unbinding adapter: %v", err)
+		}
+		return nil
+	})
+}
+
+// adapterCall is an adapter handler with a copy of its template, so it can be
+// called while the resource is unlocked
+type adapterCall struct {
+	handler  AdapterHandler
+	template PipeTemplate
+}
+
+func adapterCalls(p *Pipe) []*adapterCall {
+	calls := []*adapterCall{}
+	for _, t := range p.templates {
+		if h := getAdapterHandler(t); h != nil {
+			calls = append(calls, &adapterCall{handler: h, template: *t})
+		}
+	}
+	return calls
+}
+
+func callAdapters(calls []*adapterCall, fn func(h AdapterHandler, t *PipeTemplate) error) error {
+	for _, c := range calls {
+		if err := fn(c.handler, &c.template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAdapters calls fn for each adapter handler of p. Handlers may run
+// external commands, so the resource, which the caller has locked, is
+// unlocked while they run.
+func runAdapters(resource *Resource, p *Pipe, fn func(h AdapterHandler, t *PipeTemplate) error) error {
+	calls := adapterCalls(p)
+	if len(calls) == 0 {
+		return nil
+	}
+	return resource.unlockedFor([]string{p.ID}, func() error {
+		return callAdapters(calls, fn)
+	})
+}
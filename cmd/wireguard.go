@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const wireguardPrivateKey = "WG_PRIVATE_KEY"
+
+type wireguardHandler struct{}
+
+func (wireguardHandler) Bind(p *Pipe, t *PipeTemplate) error {
+	return setWireguardKey(p)
+}
+
+func (wireguardHandler) Update(p *Pipe, t *PipeTemplate) error {
+	return nil
+}
+
+func (wireguardHandler) Rotate(p *Pipe, t *PipeTemplate) error {
+	return setWireguardKey(p)
+}
+
+func (wireguardHandler) Unbind(p *Pipe, t *PipeTemplate) error {
+	return nil
+}
+
+// setWireguardKey generates a new keypair for this end of the pipe. The
+// public key is published in the data, the private key stays with the broker.
+func setWireguardKey(p *Pipe) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate wireguard key: %w", err)
+	}
+	if p.secrets == nil {
+		p.secrets = map[string]string{}
+	}
+	p.secrets[wireguardPrivateKey] = base64.StdEncoding.EncodeToString(key.Bytes())
+	return p.This.SetData(map[string]string{
+		"WG_PUBLIC_KEY": base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+	})
+}
+
+func renderWireguardConfig(privateKey string, this, other WireguardConnData) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	b.WriteString(fmt.Sprintf("PrivateKey = %s\n", privateKey))
+	if this.AllowedIPs != "" {
+		b.WriteString(fmt.Sprintf("Address = %s\n", this.AllowedIPs))
+	}
+	if _, port, err := net.SplitHostPort(this.Endpoint); err == nil {
+		b.WriteString(fmt.Sprintf("ListenPort = %s\n", port))
+	}
+	b.WriteString("\n[Peer]\n")
+	b.WriteString(fmt.Sprintf("PublicKey = %s\n", other.PublicKey))
+	b.WriteString(fmt.Sprintf("AllowedIPs = %s\n", other.AllowedIPs))
+	if other.Endpoint != "" {
+		b.WriteString(fmt.Sprintf("Endpoint = %s\n", other.Endpoint))
+		if this.Endpoint == "" {
+			// we are not reachable, so keep the tunnel open from our side
+			b.WriteString("PersistentKeepalive = 25\n")
+		}
+	}
+	return b.String()
+}
+
+func toWireguardConfig(pipe *Pipe, config map[string]*string) error {
+	privateKey, ok := pipe.secrets[wireguardPrivateKey]
+	if !ok || isJSONEmpty(pipe.Other.Data) {
+		return nil
+	}
+	var this, other WireguardConnData
+	if err := json.Unmarshal(pipe.Other.Data, &other); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	if other.PublicKey == "" {
+		// the other end hasn't sent its key yet
+		return nil
+	}
+	if err := json.Unmarshal(pipe.This.Data, &this); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	wgConfig := renderWireguardConfig(privateKey, this, other)
+	config[strings.ToUpper(fmt.Sprintf("PIPE_%s_WIREGUARD_CONFIG", pipe.ID))] = &wgConfig
+	config[strings.ToUpper(fmt.Sprintf("PIPE_%s_%s", pipe.ID, wireguardPrivateKey))] = &privateKey
+	return nil
+}
@@ -66,7 +66,11 @@ if [ "$euri" != "$uri" ]; then
 fi
 
 # validate that the data is updated when the underlying platform changes
-kill -INFO $provider_pid
+curl -s -X PATCH -u foo:bar $provider/resources/backend -H "Content-Type: application/json" -d '
+{
+    "data": {"URI": "https://updated.herokuapp.com"}
+}
+' | jq .
 
 sleep 1
 